@@ -0,0 +1,188 @@
+package main // Structured record of every connection that traveled a route
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const defaultAccessLogFiles = 5
+
+var errAccessLogFile = errors.New("Access log file is required")
+
+var _accessLog *AccessLog
+
+type AccessLog struct {
+	File     string `json:"file"`     // JSON lines file that records are appended to
+	MaxSize  int64  `json:"maxSize"`  // Bytes written before the file is rotated (0 = never rotated)
+	MaxFiles int    `json:"maxFiles"` // Rotated files kept as <file>.1 (newest) to <file>.<maxFiles> (0 = 5)
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+type AccessRecord struct {
+	Time        string `json:"time"` // RFC 3339 time the connection closed
+	Route       string `json:"route"`
+	RouteNumber int    `json:"routeNumber"`
+	Client      string `json:"client"`
+	Destination string `json:"destination,omitempty"`
+	User        string `json:"user,omitempty"`
+	Method      string `json:"method,omitempty"` // HTTP method when inspecting
+	Host        string `json:"host,omitempty"`   // HTTP host when inspecting
+	Shortcut    string `json:"shortcut,omitempty"`
+	ClientBytes int64  `json:"clientBytes"` // Bytes read from the client
+	ServerBytes int64  `json:"serverBytes"` // Bytes read from the server
+	Duration    int64  `json:"duration"`    // Milliseconds
+	Reason      string `json:"reason"`
+	Error       string `json:"error,omitempty"`
+}
+
+func (a *AccessLog) Open() error {
+	if len(a.File) == 0 {
+		return errAccessLogFile
+	}
+
+	if a.MaxFiles <= 0 {
+		a.MaxFiles = defaultAccessLogFiles
+	}
+
+	file, err := os.OpenFile(a.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+
+	return nil
+}
+
+// Record a trip once both of its sides have closed
+func (a *AccessLog) Trip(trip *Trip, mp Map) {
+	if a == nil {
+		return
+	}
+
+	impl := mp.GetImpl()
+
+	a.Write(AccessRecord{
+		Route:       trip.Route.Name,
+		RouteNumber: mp.GetRouteNumber(),
+		Client:      trip.src.RemoteAddr().String(),
+		Destination: trip.Destination(),
+		User:        impl.User,
+		Method:      impl.Method,
+		Host:        impl.Host,
+		Shortcut:    shortcutName(impl.Shortcut),
+		ClientBytes: trip.Bytes(Client),
+		ServerBytes: trip.Bytes(Server),
+		Duration:    int64(time.Since(trip.Start) / time.Millisecond),
+		Reason:      trip.Reason(),
+		Error:       trip.Err(),
+	})
+}
+
+// Record a connection for which no destination could be found or reached
+func (a *AccessLog) NoRoute(src net.Conn, route *Route, mp Map, start time.Time, err error) {
+	if a == nil {
+		return
+	}
+
+	record := AccessRecord{
+		Route:    route.Name,
+		Client:   src.RemoteAddr().String(),
+		Duration: int64(time.Since(start) / time.Millisecond),
+		Reason:   "no route found",
+	}
+
+	if mp != nil {
+		impl := mp.GetImpl()
+		record.RouteNumber = mp.GetRouteNumber()
+		record.User = impl.User
+		record.Method = impl.Method
+		record.Host = impl.Host
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	a.Write(record)
+}
+
+func (a *AccessLog) Write(record AccessRecord) {
+	if a == nil {
+		return
+	}
+
+	record.Time = time.Now().Format(time.RFC3339Nano)
+	line, err := json.Marshal(record)
+	if err != nil {
+		logger.PrintlnError(err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.MaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			logger.PrintlnError("Failed to rotate access log:", err.Error())
+		}
+	}
+
+	if a.file != nil {
+		n, err := a.file.Write(line)
+		a.size = a.size + int64(n)
+		if err != nil {
+			logger.PrintlnError(err.Error())
+		}
+	}
+}
+
+// Start a new file once the current one has been shifted
+func (a *AccessLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+
+	res := shiftFiles(a.File, a.MaxFiles)
+
+	// Keep appending to the current file if it could not be renamed
+	file, err := os.OpenFile(a.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	a.file = file
+	a.size = 0
+	if info, err := file.Stat(); err == nil {
+		a.size = info.Size()
+	}
+
+	return res
+}
+
+// Shift <name>.N to <name>.N+1, forgetting <name>.<keep>, and rename the
+// current file to <name>.1
+func shiftFiles(name string, keep int) error {
+	os.Remove(name + "." + strconv.Itoa(keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(name+"."+strconv.Itoa(i), name+"."+strconv.Itoa(i+1))
+	}
+
+	return os.Rename(name, name+".1")
+}
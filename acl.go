@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const aclAny = "*"
+
+var errAclDenied = errors.New("destination is not allowed on this route")
+
+// Rules are written as host[:port[-port]] where host is a name (optionally
+// prefixed with a "*." wildcard), an IP address, a CIDR range or "*" for any
+// host. IPv6 addresses and ranges must be bracketed when a port is given.
+// E.g., "*.example.com", "10.0.0.0/8:22", "[fd00::/8]:8000-9000", "*:22"
+type Acl struct {
+	Allow []string `json:"allow"` // Rules that permit travel (all destinations are permitted if empty)
+	Deny  []string `json:"deny"`  // Rules that forbid travel (evaluated before allow rules)
+	allow []aclRule
+	deny  []aclRule
+}
+
+type aclRule struct {
+	text     string
+	host     string
+	cidr     *net.IPNet
+	portLow  int
+	portHigh int
+}
+
+func (a *Acl) Load() error {
+	var err error
+
+	if a.allow, err = parseAclRules(a.Allow); err == nil {
+		a.deny, err = parseAclRules(a.Deny)
+	}
+
+	return err
+}
+
+// Check a destination against the deny rules and then the allow rules, and
+// return the text of the deciding rule
+func (a *Acl) Permits(host string, ip net.IP, port int) (string, bool) {
+	for i := range a.deny {
+		if a.deny[i].matches(host, ip, port) {
+			return "deny " + a.deny[i].text, false
+		}
+	}
+
+	for i := range a.allow {
+		if a.allow[i].matches(host, ip, port) {
+			return "allow " + a.allow[i].text, true
+		}
+	}
+
+	if len(a.allow) > 0 {
+		return "allow (no match)", false
+	}
+
+	return "", true
+}
+
+func parseAclRules(rules []string) ([]aclRule, error) {
+	parsed := make([]aclRule, 0, len(rules))
+
+	for _, text := range rules {
+		rule, err := parseAclRule(text)
+		if err != nil { // A partial list would silently drop the rules after the bad one
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+
+	return parsed, nil
+}
+
+func parseAclRule(text string) (aclRule, error) {
+	var err error
+	rule := aclRule{text: text}
+	host, ports := strings.TrimSpace(text), ""
+
+	if strings.HasPrefix(host, "[") {
+		if i := strings.Index(host, "]"); i > 0 {
+			host, ports = host[1:i], strings.TrimPrefix(host[i+1:], ":")
+		} else {
+			return rule, errors.New("invalid ACL rule '" + text + "'")
+		}
+	} else if strings.Count(host, ":") == 1 {
+		i := strings.Index(host, ":")
+		host, ports = host[:i], host[i+1:]
+	}
+
+	if len(ports) > 0 {
+		low, high := ports, ports
+		if i := strings.Index(ports, "-"); i >= 0 {
+			low, high = ports[:i], ports[i+1:]
+		}
+
+		if rule.portLow, err = strconv.Atoi(low); err == nil {
+			rule.portHigh, err = strconv.Atoi(high)
+		}
+
+		if err != nil || rule.portLow <= 0 || rule.portHigh < rule.portLow || rule.portHigh > 65535 {
+			return rule, errors.New("invalid ACL port range in rule '" + text + "'")
+		}
+	}
+
+	switch {
+	case len(host) == 0 || host == aclAny:
+	case strings.Contains(host, "/"):
+		if _, rule.cidr, err = net.ParseCIDR(host); err != nil {
+			return rule, errors.New("invalid ACL CIDR range in rule '" + text + "'")
+		}
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		rule.host = strings.ToLower(host)
+	}
+
+	return rule, nil
+}
+
+func (r *aclRule) matches(host string, ip net.IP, port int) bool {
+	if r.portLow > 0 && (port < r.portLow || port > r.portHigh) {
+		return false
+	}
+
+	if r.cidr != nil {
+		return ip != nil && r.cidr.Contains(ip)
+	}
+
+	if len(r.host) > 0 {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if strings.HasPrefix(r.host, "*.") {
+			return strings.HasSuffix(host, r.host[1:])
+		}
+		return host == r.host
+	}
+
+	return true
+}
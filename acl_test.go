@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAclRule(t *testing.T) {
+	tests := []struct {
+		text     string
+		host     string
+		cidr     string
+		portLow  int
+		portHigh int
+	}{
+		{"*", "", "", 0, 0},
+		{"*:22", "", "", 22, 22},
+		{":8000-9000", "", "", 8000, 9000},
+		{"Example.com", "example.com", "", 0, 0},
+		{"*.example.com:443", "*.example.com", "", 443, 443},
+		{"192.0.2.1", "", "192.0.2.1/32", 0, 0},
+		{"10.0.0.0/8:22", "", "10.0.0.0/8", 22, 22},
+		{"2001:db8::1", "", "2001:db8::1/128", 0, 0},
+		{"[2001:db8::1]:443", "", "2001:db8::1/128", 443, 443},
+		{"[fd00::/8]:8000-9000", "", "fd00::/8", 8000, 9000},
+		{"[fd00::/8]", "", "fd00::/8", 0, 0},
+	}
+
+	for _, test := range tests {
+		rule, err := parseAclRule(test.text)
+		if err != nil {
+			t.Errorf("%q: %v", test.text, err)
+			continue
+		}
+
+		cidr := ""
+		if rule.cidr != nil {
+			cidr = rule.cidr.String()
+		}
+
+		if rule.host != test.host || cidr != test.cidr || rule.portLow != test.portLow || rule.portHigh != test.portHigh {
+			t.Errorf("%q: got host %q, range %q, ports %d-%d", test.text, rule.host, cidr, rule.portLow, rule.portHigh)
+		}
+	}
+}
+
+func TestParseAclRuleInvalid(t *testing.T) {
+	bad := []string{
+		"[2001:db8::1:443",
+		"example.com:http",
+		"example.com:0",
+		"example.com:9000-8000",
+		"example.com:1-70000",
+		"10.0.0.0/33",
+		"[fd00::/129]:22",
+	}
+
+	for _, text := range bad {
+		if _, err := parseAclRule(text); err == nil {
+			t.Errorf("%q was parsed", text)
+		}
+	}
+
+	if rules, err := parseAclRules([]string{"10.0.0.0/8", "bogus/99", "192.0.2.0/24"}); err == nil || rules != nil {
+		t.Errorf("list with a bad rule: got %d rules (%v)", len(rules), err)
+	}
+}
+
+func TestAclPermits(t *testing.T) {
+	tests := []struct {
+		acl  Acl
+		host string
+		port int
+		want bool
+		rule string
+	}{
+		{Acl{}, "example.com", 80, true, ""},
+		{Acl{Deny: []string{"*:22"}}, "example.com", 22, false, "deny *:22"},
+		{Acl{Deny: []string{"*:22"}}, "example.com", 443, true, ""},
+		{Acl{Allow: []string{"*.example.com"}}, "www.Example.com.", 443, true, "allow *.example.com"},
+		{Acl{Allow: []string{"*.example.com"}}, "example.com", 443, false, "allow (no match)"},
+		{Acl{Allow: []string{"*.example.com"}}, "badexample.com", 443, false, "allow (no match)"},
+		{Acl{Allow: []string{"*.example.com"}, Deny: []string{"secret.example.com"}}, "secret.example.com", 443, false, "deny secret.example.com"},
+		{Acl{Allow: []string{"10.0.0.0/8:8000-9000"}}, "10.1.2.3", 8080, true, "allow 10.0.0.0/8:8000-9000"},
+		{Acl{Allow: []string{"10.0.0.0/8:8000-9000"}}, "10.1.2.3", 9001, false, "allow (no match)"},
+		{Acl{Allow: []string{"[2001:db8::/32]:443"}}, "2001:db8::5", 443, true, "allow [2001:db8::/32]:443"},
+		{Acl{Allow: []string{"10.0.0.0/8"}}, "ten.example.com", 80, false, "allow (no match)"},
+	}
+
+	for _, test := range tests {
+		if err := test.acl.Load(); err != nil {
+			t.Fatal(err)
+		}
+
+		rule, ok := test.acl.Permits(test.host, net.ParseIP(test.host), test.port)
+		if ok != test.want || rule != test.rule {
+			t.Errorf("%s:%d with allow %q deny %q: got %t (%q), want %t (%q)", test.host, test.port, test.acl.Allow, test.acl.Deny, ok, rule, test.want, test.rule)
+		}
+	}
+}
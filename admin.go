@@ -0,0 +1,283 @@
+package main // Local HTTP API for inspecting routes and the connections traveling them
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	healthDown    = "down"
+	healthUnknown = "unknown"
+	healthUp      = "up"
+)
+
+type adminDestination struct {
+	Address  string `json:"address"`
+	Health   string `json:"health"`             // "up", "down" (last dial failed) or "unknown" (never dialed)
+	Errors   int64  `json:"errors"`             // Failed dials
+	Failures int64  `json:"failures"`           // Consecutive failed dials
+	LastDial string `json:"lastDial,omitempty"` // RFC 3339 time of the last dial
+	LastErr  string `json:"lastError,omitempty"`
+}
+
+type adminRoute struct {
+	Name         string             `json:"name"`
+	Mode         string             `json:"mode"`
+	Src          string             `json:"src"`
+	Listening    bool               `json:"listening"`
+	ListenErr    string             `json:"listenError,omitempty"`
+	Connections  int64              `json:"connections"` // Connections traveling the route
+	Bandwidth    int64              `json:"bandwidth"`   // Bits per second
+	Delay        int64              `json:"delay"`       // Milliseconds
+	Flow         int                `json:"flow"`
+	RevertIn     int64              `json:"revertIn,omitempty"` // Milliseconds until an adjustment expires
+	Destinations []adminDestination `json:"destinations"`
+}
+
+type adminConnection struct {
+	Id          int64  `json:"id"`
+	Route       string `json:"route"`
+	RouteNumber int    `json:"routeNumber"`
+	Client      string `json:"client"`
+	Server      string `json:"server"`
+	User        string `json:"user,omitempty"`
+	Flow        string `json:"flow"`
+	Shortcut    string `json:"shortcut"`
+	ClientBytes int64  `json:"clientBytes"` // Bytes read from the client
+	ServerBytes int64  `json:"serverBytes"` // Bytes read from the server
+	Age         int64  `json:"age"`         // Milliseconds
+}
+
+// Test: curl -X PUT -d '{"flow":1,"duration":20000}' http://<admin address>/routes/<name>
+// Test: curl http://<admin address>/connections
+// Test: curl -X DELETE http://<admin address>/connections?destination=<host:port>
+func serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", adminRoutes)
+	mux.HandleFunc("/routes/", adminRoutes)
+	mux.HandleFunc("/connections", adminConnections)
+	mux.HandleFunc("/connections/", adminConnections)
+
+	logger.PrintlnInfo("Serving admin API on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.PrintlnError(err.Error())
+	}
+}
+
+func adminRoutes(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/routes"), "/")
+
+	stats := AllRouteStats()
+	if len(name) > 0 {
+		s, ok := FindRouteStats(name)
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, "route "+name+" not found")
+			return
+		}
+		stats = []*RouteStats{s}
+	}
+
+	switch {
+	case r.Method == http.MethodGet:
+	case r.Method == http.MethodPut && len(name) > 0:
+		var adjustment Adjustment
+		if err := json.NewDecoder(r.Body).Decode(&adjustment); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		} else if adjustment.Duration < 0 {
+			writeAdminError(w, http.StatusBadRequest, "duration must not be negative")
+			return
+		}
+
+		logger.PrintlnInfo("Admin is adjusting route", name)
+		stats[0].Route.live.Adjust(adjustment)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	routes := []adminRoute{}
+	for _, s := range stats {
+		routes = append(routes, adminRouteOf(s))
+	}
+
+	if len(name) > 0 {
+		writeAdminJson(w, http.StatusOK, routes[0])
+	} else {
+		writeAdminJson(w, http.StatusOK, routes)
+	}
+}
+
+func adminRouteOf(s *RouteStats) adminRoute {
+	listenErr := s.ListenErr()
+	live := s.Route.live
+
+	return adminRoute{
+		Name:         s.Name,
+		Mode:         routeMode(s.Route),
+		Src:          s.Route.Src,
+		Listening:    len(listenErr) == 0,
+		ListenErr:    listenErr,
+		Connections:  s.Capacity.Connections.Current(),
+		Bandwidth:    live.Bandwidth(),
+		Delay:        int64(live.Delay() / time.Millisecond),
+		Flow:         live.Flow(),
+		RevertIn:     int64(live.RevertIn() / time.Millisecond),
+		Destinations: adminDestinations(s),
+	}
+}
+
+// Configured destinations followed by any other destination the route has
+// recently failed to dial (e.g., in proxy mode)
+func adminDestinations(s *RouteStats) []adminDestination {
+	dialed := s.Destinations()
+	addrs := append([]string{}, s.Route.Dst...)
+
+	others := []string{}
+	for addr := range dialed {
+		configured := false
+		for _, dst := range s.Route.Dst {
+			configured = configured || dst == addr
+		}
+		if !configured {
+			others = append(others, addr)
+		}
+	}
+	sort.Strings(others)
+
+	destinations := []adminDestination{}
+	for _, addr := range append(addrs, others...) {
+		destination := adminDestination{Address: addr, Health: healthUnknown}
+		if d, ok := dialed[addr]; ok {
+			destination.Health = healthUp
+			if d.Failures > 0 {
+				destination.Health = healthDown
+			}
+			destination.Errors = d.Errors
+			destination.Failures = d.Failures
+			destination.LastDial = d.LastDial.Format(time.RFC3339)
+			destination.LastErr = d.LastErr
+		}
+		destinations = append(destinations, destination)
+	}
+
+	return destinations
+}
+
+func adminConnections(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/connections"), "/")
+	query := r.URL.Query()
+
+	var trips []*Trip
+	for _, trip := range ActiveTrips() {
+		if len(id) > 0 && strconv.FormatInt(trip.Id, 10) != id {
+			continue
+		} else if route := query.Get("route"); len(route) > 0 && trip.Route.Name != route {
+			continue
+		} else if dst := query.Get("destination"); len(dst) > 0 && !isTripDestination(trip, dst) {
+			continue
+		}
+		trips = append(trips, trip)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if len(id) > 0 && len(trips) == 0 {
+			writeAdminError(w, http.StatusNotFound, "connection "+id+" not found")
+			return
+		}
+
+		connections := []adminConnection{}
+		for _, trip := range trips {
+			connections = append(connections, adminTrip(trip))
+		}
+		writeAdminJson(w, http.StatusOK, connections)
+	case http.MethodDelete:
+		if len(id) == 0 && len(query.Get("route")) == 0 && len(query.Get("destination")) == 0 {
+			writeAdminError(w, http.StatusBadRequest, "a connection id, route or destination is required")
+			return
+		} else if len(id) > 0 && len(trips) == 0 {
+			writeAdminError(w, http.StatusNotFound, "connection "+id+" not found")
+			return
+		}
+
+		for _, trip := range trips {
+			logger.PrintlnInfo("Admin is closing connection", trip.Id, "on route", trip.Route.Name)
+			trip.End("closed by admin")
+		}
+		writeAdminJson(w, http.StatusOK, map[string]int{"closed": len(trips)})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func adminTrip(trip *Trip) adminConnection {
+	impl := trip.Map.GetImpl()
+
+	return adminConnection{
+		Id:          trip.Id,
+		Route:       trip.Route.Name,
+		RouteNumber: trip.Map.GetRouteNumber(),
+		Client:      trip.src.RemoteAddr().String(),
+		Server:      trip.Destination(),
+		User:        impl.User,
+		Flow:        flowText[trip.Map.GetFlow()],
+		Shortcut:    shortcutName(impl.Shortcut),
+		ClientBytes: trip.Bytes(Client),
+		ServerBytes: trip.Bytes(Server),
+		Age:         int64(time.Since(trip.Start) / time.Millisecond),
+	}
+}
+
+// Match a destination given as host:port or just a host
+func isTripDestination(trip *Trip, dst string) bool {
+	addr := trip.Destination()
+	if addr == dst {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && host == strings.Trim(dst, "[]")
+}
+
+func routeMode(route *Route) string {
+	switch {
+	case route.Socks && route.Inspect:
+		return "proxy (HTTP and SOCKS5)"
+	case route.Socks:
+		return "proxy (SOCKS5)"
+	case route.Inspect:
+		return "proxy (HTTP)"
+	case len(route.Transparent) > 0:
+		return "transparent (" + route.Transparent + ")"
+	default:
+		return "load balancer"
+	}
+}
+
+func shortcutName(shortcut Shortcut) string {
+	id := Null
+	if _, ok := shortcut.(*ShortcutAzureBlob); ok {
+		id = AzureBlob
+	}
+
+	return shortcutsSupported[id].Name
+}
+
+func writeAdminJson(w http.ResponseWriter, status int, v interface{}) {
+	body, _ := json.MarshalIndent(v, "", indent)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJson(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	overflowClose = "close"
+	overflowQueue = "queue"
+)
+
+// Limits the number of connections that may travel at the same time
+type Capacity struct {
+	Connections Gauge
+	name        string
+	seats       chan struct{}
+	queue       bool
+	wait        time.Duration
+}
+
+func NewCapacity(name string, maxConnections int, overflow string, overflowWait int64) *Capacity {
+	capacity := new(Capacity)
+	capacity.name = name
+
+	if maxConnections > 0 {
+		capacity.seats = make(chan struct{}, maxConnections)
+		capacity.queue = strings.EqualFold(overflow, overflowQueue)
+		capacity.wait = time.Duration(overflowWait) * time.Millisecond
+	}
+
+	return capacity
+}
+
+// Take a seat, waiting for one to become free if overflow connections are
+// queued
+func (c *Capacity) Acquire() bool {
+	if c.seats != nil {
+		select {
+		case c.seats <- struct{}{}:
+		default:
+			if !c.queue || !c.waitForSeat() {
+				logger.PrintlnInfo(c.name, "is full with", c.Connections.Current(), "connections (peak", strconv.FormatInt(c.Connections.Peak(), 10)+")")
+				return false
+			}
+		}
+	}
+
+	n := c.Connections.Inc()
+	logger.PrintlnDebug(c.name, "has", n, "connections (peak", strconv.FormatInt(c.Connections.Peak(), 10)+")")
+
+	return true
+}
+
+func (c *Capacity) Release() {
+	c.Connections.Dec()
+
+	if c.seats != nil {
+		<-c.seats
+	}
+}
+
+func (c *Capacity) waitForSeat() bool {
+	logger.PrintlnDebug(c.name, "is full: queuing connection")
+
+	if c.wait <= 0 {
+		c.seats <- struct{}{}
+		return true
+	}
+
+	timer := time.NewTimer(c.wait)
+	defer timer.Stop()
+
+	select {
+	case c.seats <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
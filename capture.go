@@ -0,0 +1,372 @@
+package main // pcapng capture of the bytes traveling a route
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngLinkTypeRaw    = 101 // Packets begin with an IPv4 or IPv6 header
+
+	defaultCaptureFiles = 5
+	captureIsnShift     = 16              // Initial sequence numbers are the port shifted left
+	captureSegmentSize  = 65535 - 40 - 20 // Max TCP payload that fits in either IP version with room to spare
+	captureWindow       = 65535
+
+	ipDefaultTtl     = 64
+	ipProtocolTcp    = 6
+	ipv4DontFragment = 0x4000
+	ipv4HeaderLen    = 20
+	ipv6HeaderLen    = 40
+	tcpHeaderLen     = 20
+
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpRst = 0x04
+	tcpPsh = 0x08
+	tcpAck = 0x10
+)
+
+var errCaptureFile = errors.New("Capture file is required")
+
+// Records each connection of a route as a TCP stream between the client and
+// the destination with synthesized headers. Rotated files are kept as
+// <file>.1 (newest) to <file>.<maxFiles>.
+type Capture struct {
+	File     string   `json:"file"`     // pcapng file
+	MaxSize  int64    `json:"maxSize"`  // Bytes written before the file is rotated (0 = unlimited)
+	MaxAge   int64    `json:"maxAge"`   // Milliseconds before the file is rotated (0 = unlimited)
+	MaxFiles int      `json:"maxFiles"` // Rotated files kept (0 = 5)
+	Clients  []string `json:"clients"`  // Client addresses or CIDR ranges to capture (all clients if empty)
+	clients  []aclRule
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+// One captured connection
+type CaptureStream struct {
+	capture *Capture
+	mutex   sync.Mutex
+	ip      [2]net.IP // Client and server addresses
+	port    [2]uint16
+	seq     [2]uint32 // Next sequence number sent by each side
+	closed  [2]bool
+	reset   bool
+}
+
+func (c *Capture) Load() error {
+	var err error
+
+	if len(c.File) == 0 {
+		return errCaptureFile
+	} else if c.clients, err = parseAclRules(c.Clients); err != nil {
+		return err
+	}
+
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = defaultCaptureFiles
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, err := os.Stat(c.File); err == nil { // Keep the capture of a previous run
+		shiftFiles(c.File, c.MaxFiles)
+	}
+
+	return c.open()
+}
+
+func (c *Capture) open() error {
+	file, err := os.OpenFile(c.File, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	c.file = file
+	c.size = 0
+	c.opened = time.Now()
+
+	return c.write(pcapngHeader())
+}
+
+func (c *Capture) write(block []byte) error {
+	if c.file == nil {
+		return nil
+	}
+
+	n, err := c.file.Write(block)
+	c.size = c.size + int64(n)
+
+	return err
+}
+
+// Write a block, rotating the file first if it is too large or too old
+func (c *Capture) writeBlock(block []byte, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if (c.MaxSize > 0 && c.size+int64(len(block)) > c.MaxSize) || (c.MaxAge > 0 && now.Sub(c.opened) >= time.Duration(c.MaxAge)*time.Millisecond) {
+		if c.file != nil {
+			c.file.Close()
+			c.file = nil
+		}
+
+		if err := shiftFiles(c.File, c.MaxFiles); err != nil {
+			logger.PrintlnError("Failed to rotate capture:", err.Error())
+		}
+
+		if err := c.open(); err != nil {
+			logger.PrintlnError("Failed to open capture:", err.Error())
+		}
+	}
+
+	if err := c.write(block); err != nil {
+		logger.PrintlnError(err.Error())
+	}
+}
+
+// Start capturing a connection that arrived at start unless its client is
+// filtered out. Returns nil if the connection is not captured.
+func (c *Capture) Open(src net.Conn, dst net.Conn, start time.Time) *CaptureStream {
+	if c == nil {
+		return nil
+	}
+
+	ip, port := captureAddr(src.RemoteAddr())
+	if ip == nil {
+		return nil
+	}
+
+	if len(c.clients) > 0 {
+		captured := false
+		for i := range c.clients {
+			captured = captured || c.clients[i].matches("", ip, int(port))
+		}
+		if !captured {
+			return nil
+		}
+	}
+
+	stream := new(CaptureStream)
+	stream.capture = c
+	stream.ip[Client], stream.port[Client] = ip, port
+	stream.ip[Server], stream.port[Server] = captureAddr(dst.RemoteAddr())
+	if stream.ip[Server] == nil {
+		return nil
+	}
+
+	if v4, v4Server := stream.ip[Client].To4(), stream.ip[Server].To4(); v4 != nil && v4Server != nil {
+		stream.ip[Client], stream.ip[Server] = v4, v4Server
+	} else { // Mixed families are captured as IPv6 with IPv4-mapped addresses
+		stream.ip[Client], stream.ip[Server] = stream.ip[Client].To16(), stream.ip[Server].To16()
+	}
+
+	// Synthesize the handshake so that the stream can be followed
+	now := start
+	stream.seq[Client] = uint32(port) << captureIsnShift
+	stream.seq[Server] = uint32(stream.port[Server]) << captureIsnShift
+	stream.packet(Client, tcpSyn, nil, now)
+	stream.seq[Client] = stream.seq[Client] + 1
+	stream.packet(Server, tcpSyn|tcpAck, nil, now)
+	stream.seq[Server] = stream.seq[Server] + 1
+	stream.packet(Client, tcpAck, nil, now)
+
+	return stream
+}
+
+// Record bytes read from one side of the connection
+func (s *CaptureStream) Travel(role Role, buffer []byte) {
+	s.travel(role, buffer, time.Now())
+}
+
+func (s *CaptureStream) travel(role Role, buffer []byte, now time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.reset || s.closed[role] {
+		return
+	}
+
+	for len(buffer) > 0 {
+		size := len(buffer)
+		if size > captureSegmentSize {
+			size = captureSegmentSize
+		}
+
+		s.packet(role, tcpPsh|tcpAck, buffer[:size], now)
+		s.seq[role] = s.seq[role] + uint32(size)
+		buffer = buffer[size:]
+	}
+}
+
+// Record one side of the connection closing normally (io.EOF) or not
+func (s *CaptureStream) Finish(role Role, err error) {
+	if s == nil {
+		return
+	}
+
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.reset || s.closed[role] {
+		return
+	}
+
+	if err == io.EOF {
+		s.packet(role, tcpFin|tcpAck, nil, now)
+		s.seq[role] = s.seq[role] + 1
+		s.closed[role] = true
+	} else {
+		s.packet(role, tcpRst|tcpAck, nil, now)
+		s.reset = true
+	}
+}
+
+// Write a packet sent by one side of the connection
+func (s *CaptureStream) packet(role Role, flags byte, payload []byte, now time.Time) {
+	peer := Server
+	if role == Server {
+		peer = Client
+	}
+
+	ack := uint32(0)
+	if flags&tcpAck != 0 {
+		ack = s.seq[peer]
+	}
+
+	tcp := make([]byte, tcpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], s.port[role])
+	binary.BigEndian.PutUint16(tcp[2:], s.port[peer])
+	binary.BigEndian.PutUint32(tcp[4:], s.seq[role])
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = (tcpHeaderLen / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], captureWindow)
+	copy(tcp[tcpHeaderLen:], payload)
+
+	var ip []byte
+	if src, dst := s.ip[role], s.ip[peer]; len(src) == net.IPv4len {
+		ip = make([]byte, ipv4HeaderLen, ipv4HeaderLen+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(ipv4HeaderLen+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], ipv4DontFragment)
+		ip[8] = ipDefaultTtl
+		ip[9] = ipProtocolTcp
+		copy(ip[12:], src)
+		copy(ip[16:], dst)
+		binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip, 0))
+
+		pseudo := append(append([]byte{}, src...), dst...)
+		pseudo = append(pseudo, 0, ipProtocolTcp, byte(len(tcp)>>8), byte(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], internetChecksum(tcp, internetSum(pseudo)))
+	} else {
+		ip = make([]byte, ipv6HeaderLen, ipv6HeaderLen+len(tcp))
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = ipProtocolTcp
+		ip[7] = ipDefaultTtl
+		copy(ip[8:], src)
+		copy(ip[24:], dst)
+
+		pseudo := append(append([]byte{}, src...), dst...)
+		pseudo = append(pseudo, 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, ipProtocolTcp)
+		binary.BigEndian.PutUint16(tcp[16:], internetChecksum(tcp, internetSum(pseudo)))
+	}
+
+	s.capture.writeBlock(pcapngPacket(append(ip, tcp...), now), now)
+}
+
+func captureAddr(addr net.Addr) (net.IP, uint16) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, 0
+	}
+
+	n, _ := strconv.Atoi(port)
+	return net.ParseIP(host), uint16(n)
+}
+
+// Sum 16-bit big-endian words as the Internet checksum does
+func internetSum(data []byte) uint32 {
+	var total uint32
+	for i := 0; i+1 < len(data); i = i + 2 {
+		total = total + uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+
+	if len(data)%2 == 1 {
+		total = total + uint32(data[len(data)-1])<<8
+	}
+
+	return total
+}
+
+func internetChecksum(data []byte, initial uint32) uint16 {
+	total := initial + internetSum(data)
+	for total > 0xffff {
+		total = (total >> 16) + (total & 0xffff)
+	}
+
+	return ^uint16(total)
+}
+
+// Section header and interface description blocks that begin every file
+func pcapngHeader() []byte {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1)                  // Major version
+	binary.LittleEndian.PutUint16(shb[14:], 0)                  // Minor version
+	binary.LittleEndian.PutUint64(shb[16:], 0xffffffffffffffff) // Section length is unknown
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterface)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[12:], 0) // No snapshot length limit
+	binary.LittleEndian.PutUint32(idb[16:], uint32(len(idb)))
+
+	return append(shb, idb...)
+}
+
+// Enhanced packet block with a timestamp in microseconds (the default
+// resolution)
+func pcapngPacket(packet []byte, now time.Time) []byte {
+	padded := (len(packet) + 3) &^ 3
+	epb := make([]byte, 32+padded)
+	ts := uint64(now.UnixNano() / int64(time.Microsecond))
+
+	binary.LittleEndian.PutUint32(epb[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(epb[4:], uint32(len(epb)))
+	binary.LittleEndian.PutUint32(epb[8:], 0) // Interface
+	binary.LittleEndian.PutUint32(epb[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[24:], uint32(len(packet)))
+	copy(epb[28:], packet)
+	binary.LittleEndian.PutUint32(epb[28+padded:], uint32(len(epb)))
+
+	return epb
+}
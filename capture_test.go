@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInternetChecksum(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want uint16
+	}{
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0x220d}, // RFC 1071
+		{[]byte{0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}, 0xb861},
+		{[]byte{0x01}, 0xfeff},
+	}
+
+	for _, test := range tests {
+		if got := internetChecksum(test.data, 0); got != test.want {
+			t.Errorf("% x: got %#04x, want %#04x", test.data, got, test.want)
+		}
+	}
+}
+
+// A captured packet along with whether its checksums hold
+type capturedPacket struct {
+	src, dst uint16
+	seq      uint32
+	flags    byte
+	payload  []byte
+	ipSum    bool
+	tcpSum   bool
+}
+
+func readCapture(t *testing.T, name string) []capturedPacket {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := pcapngHeader()
+	if len(b) < len(header) || string(b[:len(header)]) != string(header) {
+		t.Fatal("capture does not begin with the section header and interface description")
+	}
+	b = b[len(header):]
+
+	var packets []capturedPacket
+	for len(b) > 0 {
+		if len(b) < 32 || binary.LittleEndian.Uint32(b) != pcapngEnhancedPacket {
+			t.Fatal("capture has a block that is not an enhanced packet")
+		}
+
+		size := binary.LittleEndian.Uint32(b[4:])
+		if size > uint32(len(b)) || binary.LittleEndian.Uint32(b[size-4:]) != size {
+			t.Fatal("capture has a block with mismatched lengths")
+		}
+
+		ip := b[28 : 28+binary.LittleEndian.Uint32(b[20:])]
+		b = b[size:]
+
+		var tcp, pseudo []byte
+		packet := capturedPacket{ipSum: true}
+		if ip[0]>>4 == 4 {
+			tcp = ip[ipv4HeaderLen:]
+			packet.ipSum = internetChecksum(ip[:ipv4HeaderLen], 0) == 0
+			pseudo = append(append([]byte{}, ip[12:20]...), 0, ipProtocolTcp, byte(len(tcp)>>8), byte(len(tcp)))
+		} else {
+			tcp = ip[ipv6HeaderLen:]
+			pseudo = append(append([]byte{}, ip[8:40]...), 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, ipProtocolTcp)
+		}
+
+		packet.tcpSum = internetChecksum(tcp, internetSum(pseudo)) == 0
+		packet.src = binary.BigEndian.Uint16(tcp[0:])
+		packet.dst = binary.BigEndian.Uint16(tcp[2:])
+		packet.seq = binary.BigEndian.Uint32(tcp[4:])
+		packet.flags = tcp[13]
+		packet.payload = tcp[tcpHeaderLen:]
+		packets = append(packets, packet)
+	}
+
+	return packets
+}
+
+func TestCaptureStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		client string
+		server string
+	}{
+		{"192.0.2.1:51000", "198.51.100.2:443"},
+		{"[2001:db8::1]:51000", "[2001:db8::2]:443"},
+		{"192.0.2.1:51000", "[2001:db8::2]:443"},
+	}
+
+	for i, test := range tests {
+		client, _ := net.ResolveTCPAddr("tcp", test.client)
+		server, _ := net.ResolveTCPAddr("tcp", test.server)
+
+		capture := &Capture{File: filepath.Join(dir, "capture.pcapng"), MaxFiles: 1}
+		if err := capture.Load(); err != nil {
+			t.Fatal(err)
+		}
+
+		stream := capture.Open(&replayConn{remote: client}, &replayConn{remote: server}, time.Now())
+		stream.Travel(Client, []byte("hello"))
+		stream.Travel(Server, []byte("world!"))
+		stream.Finish(Client, io.EOF)
+		stream.Finish(Server, io.EOF)
+		capture.file.Close()
+
+		packets := readCapture(t, capture.File)
+		flags := []byte{tcpSyn, tcpSyn | tcpAck, tcpAck, tcpPsh | tcpAck, tcpPsh | tcpAck, tcpFin | tcpAck, tcpFin | tcpAck}
+		if len(packets) != len(flags) {
+			t.Fatalf("%d: got %d packets, want %d", i, len(packets), len(flags))
+		}
+
+		isn := [2]uint32{uint32(client.Port) << captureIsnShift, uint32(server.Port) << captureIsnShift}
+		for j, packet := range packets {
+			if !packet.ipSum || !packet.tcpSum {
+				t.Errorf("%d: packet %d has a bad IP (%t) or TCP (%t) checksum", i, j, packet.ipSum, packet.tcpSum)
+			}
+			if packet.flags != flags[j] {
+				t.Errorf("%d: packet %d has flags %#02x, want %#02x", i, j, packet.flags, flags[j])
+			}
+		}
+
+		if p := packets[3]; p.src != uint16(client.Port) || p.seq != isn[Client]+1 || string(p.payload) != "hello" {
+			t.Errorf("%d: client sent %q from port %d at sequence %d", i, p.payload, p.src, p.seq)
+		}
+		if p := packets[4]; p.src != uint16(server.Port) || p.seq != isn[Server]+1 || string(p.payload) != "world!" {
+			t.Errorf("%d: server sent %q from port %d at sequence %d", i, p.payload, p.src, p.seq)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main // Entry control for travelers arriving at a route's source
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shanebarnes/goto/tokenbucket"
+)
+
+const checkpointSweepInterval = time.Minute
+
+type traveler struct {
+	active   int
+	arrivals *tokenbucket.TokenBucket
+	lastSeen time.Time
+}
+
+type Checkpoint struct {
+	route     *Route
+	mutex     sync.Mutex
+	travelers map[string]*traveler
+	lastSweep time.Time
+}
+
+func NewCheckpoint(route *Route) *Checkpoint {
+	checkpoint := new(Checkpoint)
+	checkpoint.route = route
+	checkpoint.travelers = make(map[string]*traveler)
+	checkpoint.lastSweep = time.Now()
+	return checkpoint
+}
+
+// Decide whether a newly accepted connection may travel the route and, if
+// not, return the reason it was refused
+func (c *Checkpoint) Admit(con net.Conn) (string, bool) {
+	ip := remoteIP(con)
+
+	if c.route.SrcAcl != nil {
+		if rule, ok := c.route.SrcAcl.Permits("", ip, remotePort(con)); !ok {
+			return "client denied by rule '" + rule + "'", false
+		}
+	}
+
+	if c.route.SrcLimit <= 0 && c.route.SrcRate <= 0 {
+		return "", true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastSweep) >= checkpointSweepInterval {
+		c.sweep(now)
+	}
+
+	t, ok := c.travelers[ip.String()]
+	if !ok {
+		t = new(traveler)
+		if c.route.SrcRate > 0 {
+			t.arrivals = tokenbucket.New(uint64(c.route.SrcRate), uint64(c.route.SrcRate))
+		}
+		c.travelers[ip.String()] = t
+	}
+	t.lastSeen = now
+
+	if c.route.SrcLimit > 0 && t.active >= c.route.SrcLimit {
+		return "client has " + strconv.Itoa(t.active) + " active connections", false
+	}
+
+	if t.arrivals != nil && t.arrivals.Request(1) < 1 {
+		return "client exceeded " + strconv.Itoa(c.route.SrcRate) + " new connections per second", false
+	}
+
+	t.active = t.active + 1
+
+	return "", true
+}
+
+// Release a connection that was previously admitted
+func (c *Checkpoint) Depart(con net.Conn) {
+	if c.route.SrcLimit <= 0 && c.route.SrcRate <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if t, ok := c.travelers[remoteIP(con).String()]; ok && t.active > 0 {
+		t.active = t.active - 1
+		t.lastSeen = time.Now()
+	}
+}
+
+// Forget clients that have been idle long enough for their arrival rate to
+// have recovered
+func (c *Checkpoint) sweep(now time.Time) {
+	for ip, t := range c.travelers {
+		if t.active == 0 && now.Sub(t.lastSeen) >= checkpointSweepInterval {
+			delete(c.travelers, ip)
+		}
+	}
+
+	c.lastSweep = now
+}
+
+func remoteIP(con net.Conn) net.IP {
+	if addr, ok := con.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return nil
+}
+
+func remotePort(con net.Conn) int {
+	if addr, ok := con.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+
+	return 0
+}
@@ -0,0 +1,178 @@
+package main // Impairments of a route that may change while connections travel it
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+	"github.com/shanebarnes/goto/tokenbucket"
+)
+
+type Conditions struct {
+	name      string
+	bandwidth int64 // Bits per second
+	delay     int64 // Milliseconds
+	flow      int64 // Same values as a route's flow
+	override  int32 // Non-zero once the flow also applies to connections already traveling
+	changes   int64 // Incremented whenever the conditions change
+	mutex     sync.Mutex
+	saved     *Adjustment // Conditions restored when the adjustment expires
+	revert    *time.Timer
+	revertAt  time.Time
+	revertGen int64
+}
+
+// A change to the conditions of a route. Omitted fields are left unchanged.
+type Adjustment struct {
+	Bandwidth *int64 `json:"bandwidth"` // Bits per second
+	Delay     *int64 `json:"delay"`     // Milliseconds
+	Flow      *int   `json:"flow"`      // Same values as a route's flow
+	Duration  int64  `json:"duration"`  // Milliseconds until the adjusted conditions are restored (0 = permanent)
+}
+
+func NewConditions(route *Route) *Conditions {
+	conditions := new(Conditions)
+	conditions.name = route.Name
+	conditions.bandwidth = route.Bandwidth
+	conditions.delay = route.Delay
+	conditions.flow = int64(route.Flow)
+	return conditions
+}
+
+func (c *Conditions) Bandwidth() int64 {
+	return atomic.LoadInt64(&c.bandwidth)
+}
+
+func (c *Conditions) Delay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.delay)) * time.Millisecond
+}
+
+func (c *Conditions) Flow() int {
+	return int(atomic.LoadInt64(&c.flow))
+}
+
+// Return the flow of connections already traveling the route if it was
+// adjusted to be closed, one-way or two-way
+func (c *Conditions) FlowOverride() (Flow, bool) {
+	if atomic.LoadInt32(&c.override) == 0 {
+		return Closed, false
+	}
+
+	switch flow := c.Flow(); {
+	case flow == 1:
+		return OneWay, true
+	case flow == 2:
+		return TwoWay, true
+	case flow <= 0:
+		return Closed, true
+	}
+
+	return Closed, false
+}
+
+// Return a number that changes whenever the conditions do
+func (c *Conditions) Changes() int64 {
+	return atomic.LoadInt64(&c.changes)
+}
+
+// Return the time left until an adjustment expires or 0 if none will
+func (c *Conditions) RevertIn() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.revert == nil {
+		return 0
+	}
+
+	return time.Until(c.revertAt)
+}
+
+// Change the conditions now and, if the adjustment has a duration, restore
+// the conditions it replaced once it expires. A permanent adjustment cancels
+// any pending restore.
+func (c *Conditions) Adjust(a Adjustment) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.revert != nil {
+		c.revert.Stop()
+		c.revert = nil
+	}
+
+	if a.Duration > 0 {
+		if c.saved == nil {
+			c.saved = new(Adjustment)
+		}
+
+		if a.Bandwidth != nil && c.saved.Bandwidth == nil {
+			bandwidth := c.Bandwidth()
+			c.saved.Bandwidth = &bandwidth
+		}
+
+		if a.Delay != nil && c.saved.Delay == nil {
+			delay := atomic.LoadInt64(&c.delay)
+			c.saved.Delay = &delay
+		}
+
+		if a.Flow != nil && c.saved.Flow == nil {
+			flow := c.Flow()
+			c.saved.Flow = &flow
+		}
+
+		c.revertGen = c.revertGen + 1
+		gen := c.revertGen
+		c.revertAt = time.Now().Add(time.Duration(a.Duration) * time.Millisecond)
+		c.revert = time.AfterFunc(time.Duration(a.Duration)*time.Millisecond, func() { c.restore(gen) })
+	} else {
+		c.saved = nil
+	}
+
+	c.apply(a)
+}
+
+func (c *Conditions) restore(gen int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if gen != c.revertGen || c.saved == nil { // Replaced by a later adjustment
+		return
+	}
+
+	logger.PrintlnInfo("Route", c.name, "adjustment expired")
+	c.apply(*c.saved)
+	c.saved = nil
+	c.revert = nil
+}
+
+func (c *Conditions) apply(a Adjustment) {
+	if a.Bandwidth != nil {
+		atomic.StoreInt64(&c.bandwidth, *a.Bandwidth)
+	}
+
+	if a.Delay != nil {
+		atomic.StoreInt64(&c.delay, *a.Delay)
+	}
+
+	if a.Flow != nil {
+		atomic.StoreInt64(&c.flow, int64(*a.Flow))
+		atomic.StoreInt32(&c.override, 1)
+	}
+
+	atomic.AddInt64(&c.changes, 1)
+
+	logger.PrintlnInfo("Route", c.name, "conditions are bandwidth", strconv.FormatInt(c.Bandwidth(), 10), "bps, delay", c.Delay().String()+", flow", c.Flow())
+}
+
+// Shape traffic to a bandwidth in bits per second
+func newBandwidthBucket(bandwidth int64, bufferSize uint64) *tokenbucket.TokenBucket {
+	rate := uint64(bandwidth / 8)
+
+	size := rate * 10
+	if bufferSize > rate {
+		size = bufferSize * 10
+	}
+
+	return tokenbucket.New(rate, size)
+}
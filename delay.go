@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const delayQueueLen = 1024 // Buffers held back before reading from the source pauses
+
+type delayedBuffer struct {
+	due    time.Time
+	buffer []byte
+}
+
+// Holds detoured bytes back to emulate a longer route while keeping them in
+// order
+type Delayer struct {
+	forward ForwardOp
+	queue   chan delayedBuffer
+	done    chan struct{}
+	pending int64
+}
+
+func NewDelayer(forward ForwardOp) *Delayer {
+	delayer := new(Delayer)
+	delayer.forward = forward
+	return delayer
+}
+
+// Forward a buffer now or, if the route is delayed or earlier bytes are still
+// held back, once the delay has passed
+func (d *Delayer) Detour(buffer []byte, delay time.Duration) {
+	if delay <= 0 && atomic.LoadInt64(&d.pending) == 0 {
+		d.forward(buffer)
+		return
+	}
+
+	if d.queue == nil {
+		d.queue = make(chan delayedBuffer, delayQueueLen)
+		d.done = make(chan struct{})
+		go d.run()
+	}
+
+	atomic.AddInt64(&d.pending, 1)
+	d.queue <- delayedBuffer{due: time.Now().Add(delay), buffer: append([]byte(nil), buffer...)}
+}
+
+func (d *Delayer) run() {
+	for b := range d.queue {
+		if wait := time.Until(b.due); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		d.forward(b.buffer)
+		atomic.AddInt64(&d.pending, -1)
+	}
+
+	close(d.done)
+}
+
+// Wait for every held back buffer to be forwarded
+func (d *Delayer) Close() {
+	if d.queue != nil {
+		close(d.queue)
+		<-d.done
+		d.queue = nil
+	}
+}
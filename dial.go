@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+// Connect to a destination on behalf of a client traveling a route. Returns
+// the address dialed, which is not the peer of the connection when the route
+// departs through an upstream proxy.
+func dialDestination(route *Route, src net.Conn, addr string) (net.Conn, string, error) {
+	start := time.Now()
+	dst, dstAddr, err := dial(route, addr)
+
+	if route != nil {
+		route.stats.Dial(addr, time.Since(start), err)
+	}
+
+	if err == nil && route != nil && len(route.ProxyOut) > 0 {
+		if err = writeProxyHeader(dst, route.ProxyOut, src.RemoteAddr(), src.LocalAddr()); err != nil {
+			dst.Close()
+			dst = nil
+		}
+	}
+
+	return dst, dstAddr, err
+}
+
+// When the route restricts its destinations, host names are resolved first and
+// the permitted address is dialed directly so that a second lookup cannot
+// rebind the name elsewhere.
+func dial(route *Route, addr string) (net.Conn, string, error) {
+	if route == nil {
+		dst, err := net.Dial("tcp", addr)
+		return dst, addr, err
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(route.ConnectTimeout) * time.Millisecond}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	portNum, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if route.DstAcl == nil {
+		return dialVia(route, dialer, host, net.ParseIP(host), portNum, addr)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = errAclDenied
+	for _, ip := range ips {
+		if rule, ok := route.DstAcl.Permits(host, ip, portNum); ok {
+			var dst net.Conn
+			var dstAddr string
+			if dst, dstAddr, err = dialVia(route, dialer, host, ip, portNum, net.JoinHostPort(ip.String(), port)); err == nil {
+				return dst, dstAddr, nil
+			}
+		} else {
+			logger.PrintlnInfo("Denied route to", addr, "("+ip.String()+")", "by rule", "'"+rule+"'")
+		}
+	}
+
+	return nil, "", err
+}
+
+// Connect directly or through the route's parent proxy
+func dialVia(route *Route, dialer *net.Dialer, host string, ip net.IP, port int, addr string) (net.Conn, string, error) {
+	if route.Upstream != nil && route.Upstream.Proxies(host, ip, port) {
+		dst, err := route.Upstream.Dial(dialer, addr)
+		return dst, addr, err
+	}
+
+	dst, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return dst, dst.RemoteAddr().String(), nil
+}
+
+// Resolve the destination of a datagram, applying the route's destination
+// rules the same way dial does for connections
+func resolveDatagram(route *Route, addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	portNum, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		if route == nil || route.DstAcl == nil {
+			return &net.UDPAddr{IP: ip, Port: portNum}, nil
+		} else if rule, ok := route.DstAcl.Permits(host, ip, portNum); ok {
+			return &net.UDPAddr{IP: ip, Port: portNum}, nil
+		} else {
+			logger.PrintlnInfo("Denied datagrams to", addr, "("+ip.String()+")", "by rule", "'"+rule+"'")
+		}
+	}
+
+	return nil, errAclDenied
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Accept one tunnel request as an HTTP parent proxy
+func testParentProxy(t *testing.T, ln net.Listener) {
+	con, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer con.Close()
+
+	if request, err := http.ReadRequest(bufio.NewReader(con)); err != nil || request.Method != methodConnect {
+		t.Errorf("parent proxy got %+v (%v)", request, err)
+		return
+	}
+	con.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	con.Read(make([]byte, 1))
+}
+
+// Trips through a parent proxy are to the destination dialed, not to the
+// proxy
+func TestDialDestinationAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go testParentProxy(t, ln)
+
+	route := &Route{Upstream: &Upstream{Proxy: "http://" + ln.Addr().String()}}
+	if err = route.Upstream.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, dstAddr, err := dialDestination(route, nil, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if dstAddr != "example.com:443" {
+		t.Errorf("dialed %q through the parent proxy, want example.com:443", dstAddr)
+	}
+
+	trip := NewTrip(nil, dst)
+	trip.dstAddr = dstAddr
+	if !isTripDestination(trip, "example.com") || !isTripDestination(trip, "example.com:443") || isTripDestination(trip, ln.Addr().String()) {
+		t.Errorf("trip to %s through %s matched the wrong destination", trip.Destination(), ln.Addr())
+	}
+
+	// Dialed directly, the destination is the peer
+	direct, dstAddr, err := dialDestination(&Route{}, nil, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Close()
+
+	if dstAddr != direct.RemoteAddr().String() {
+		t.Errorf("dialed %q directly, want %s", dstAddr, direct.RemoteAddr())
+	}
+}
@@ -0,0 +1,213 @@
+package main // Faults injected into the connections traveling a route
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	faultReset    = "reset"    // Close both sides with a TCP RST
+	faultStall    = "stall"    // Hold back one direction for a while
+	faultTruncate = "truncate" // Close both sides normally, cutting a direction short
+)
+
+var errFaultType = errors.New("fault type must be \"reset\", \"stall\" or \"truncate\"")
+
+// The random choices for a connection are drawn from a source seeded with the
+// seed and the connection number so that a run can be repeated no matter the
+// order in which connections arrive
+type Faults struct {
+	Seed   int64   `json:"seed"`   // Seed of the random choices
+	Refuse float64 `json:"refuse"` // Percentage of connections refused with a TCP RST
+	Rules  []Fault `json:"rules"`
+}
+
+// A fault is triggered once a side has sent a number of bytes or, if after is
+// set, once the connection has traveled for a while
+type Fault struct {
+	Type        string  `json:"type"`        // "reset", "stall" or "truncate"
+	Side        string  `json:"side"`        // Side whose bytes trigger the fault and are stalled or truncated ("client" or "server", default "server")
+	Bytes       int64   `json:"bytes"`       // Bytes sent by the side before the fault is triggered
+	After       int64   `json:"after"`       // Milliseconds (time traveled before the fault is triggered, 0 = triggered by bytes)
+	Duration    int64   `json:"duration"`    // Milliseconds (time a stall lasts)
+	Probability float64 `json:"probability"` // Percentage of connections the fault is injected into (0 = 100)
+	role        Role
+}
+
+// Faults chosen for one connection
+type FaultPlan struct {
+	name    string // Route and connection the faults are injected into
+	refused bool
+	faults  []*Fault
+	mutex   sync.Mutex
+	bytes   [2]int64
+	start   time.Time
+	done    []bool // Faults already triggered
+}
+
+func (f *Faults) Load() error {
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+		switch rule.Type {
+		case faultReset, faultStall, faultTruncate:
+		default:
+			return errFaultType
+		}
+
+		rule.role = Server
+		if role, ok := textRole[rule.Side]; ok {
+			rule.role = role
+		}
+	}
+
+	return nil
+}
+
+func chance(random *rand.Rand, percentage float64) bool {
+	return random.Float64()*100 < percentage
+}
+
+// Choose the faults injected into a connection. Returns nil if the route
+// injects none.
+func (f *Faults) Plan(route *Route, routeCount int) *FaultPlan {
+	if f == nil {
+		return nil
+	}
+
+	plan := new(FaultPlan)
+	plan.name = "route " + route.Name + " connection " + strconv.Itoa(routeCount)
+	plan.start = time.Now()
+
+	random := rand.New(rand.NewSource(f.Seed + int64(routeCount)))
+	plan.refused = chance(random, f.Refuse)
+	for i := range f.Rules {
+		probability := f.Rules[i].Probability
+		if probability == 0 {
+			probability = 100
+		}
+		if chance(random, probability) {
+			plan.faults = append(plan.faults, &f.Rules[i])
+		}
+	}
+
+	plan.done = make([]bool, len(plan.faults))
+
+	return plan
+}
+
+func (p *FaultPlan) Refuses() bool {
+	return p != nil && p.refused
+}
+
+// Start the faults triggered by time
+func (p *FaultPlan) Start(trip *Trip) {
+	if p == nil {
+		return
+	}
+
+	for i, fault := range p.faults {
+		if fault.After > 0 && fault.Type != faultStall {
+			i, fault := i, fault
+			timer := time.AfterFunc(time.Until(p.start.Add(time.Duration(fault.After)*time.Millisecond)), func() {
+				if p.trigger(i) {
+					p.Inject(fault, trip)
+				}
+			})
+			go func() {
+				<-trip.done
+				timer.Stop()
+			}()
+		}
+	}
+}
+
+func (p *FaultPlan) trigger(i int) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.done[i] {
+		return false
+	}
+
+	p.done[i] = true
+	return true
+}
+
+// Count bytes read from a side and return how many of them travel before a
+// fault is triggered along with the fault, if any
+func (p *FaultPlan) Travel(role Role, size int) (int, *Fault) {
+	if p == nil {
+		return size, nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	next := -1 // Byte-triggered fault reached first, whatever order the rules are in
+	for i, fault := range p.faults {
+		if p.done[i] || fault.role != role {
+			continue
+		}
+
+		if fault.After > 0 {
+			if fault.Type == faultStall && time.Since(p.start) >= time.Duration(fault.After)*time.Millisecond {
+				p.done[i] = true
+				return 0, fault
+			}
+		} else if next < 0 || fault.Bytes < p.faults[next].Bytes {
+			next = i
+		}
+	}
+
+	if next >= 0 {
+		fault := p.faults[next]
+		if left := fault.Bytes - p.bytes[role]; left <= int64(size) {
+			if left < 0 {
+				left = 0
+			}
+			p.done[next] = true
+			p.bytes[role] = p.bytes[role] + left
+			return int(left), fault
+		}
+	}
+
+	p.bytes[role] = p.bytes[role] + int64(size)
+	return size, nil
+}
+
+// Inject a fault into a trip. Returns true if the trip may go on.
+func (p *FaultPlan) Inject(fault *Fault, trip *Trip) bool {
+	reason := "fault: " + fault.Type + " of " + roleText[fault.role] + " side"
+	if fault.After > 0 {
+		reason = reason + " after " + (time.Duration(fault.After) * time.Millisecond).String()
+	} else {
+		reason = reason + " after " + strconv.FormatInt(fault.Bytes, 10) + " bytes"
+	}
+
+	logger.PrintlnInfo("Injecting", reason, "into", p.name)
+
+	switch fault.Type {
+	case faultStall:
+		time.Sleep(time.Duration(fault.Duration) * time.Millisecond)
+		return true
+	case faultReset:
+		resetConn(trip.src)
+		resetConn(trip.dst)
+	}
+
+	trip.End(reason)
+	return false
+}
+
+// Have the next close send a TCP RST rather than a FIN
+func resetConn(con net.Conn) {
+	if tcpCon, ok := unwrapConn(con).(*net.TCPConn); ok {
+		tcpCon.SetLinger(0)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+type faultEvent struct {
+	offset int64 // Bytes traveled by the side when the fault is triggered
+	fault  string
+}
+
+func TestFaultPlanTravel(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Fault
+		role  Role
+		reads []int
+		want  []faultEvent
+	}{
+		{
+			"configuration order",
+			[]Fault{{Type: faultStall, Bytes: 10}, {Type: faultTruncate, Bytes: 20}},
+			Server, []int{100},
+			[]faultEvent{{10, faultStall}, {20, faultTruncate}},
+		},
+		{
+			"reverse order",
+			[]Fault{{Type: faultTruncate, Bytes: 20}, {Type: faultStall, Bytes: 10}},
+			Server, []int{100},
+			[]faultEvent{{10, faultStall}, {20, faultTruncate}},
+		},
+		{
+			"reverse order across reads",
+			[]Fault{{Type: faultStall, Bytes: 25}, {Type: faultStall, Bytes: 5}, {Type: faultStall, Bytes: 15}},
+			Server, []int{8, 8, 8, 8},
+			[]faultEvent{{5, faultStall}, {15, faultStall}, {25, faultStall}},
+		},
+		{
+			"same offset",
+			[]Fault{{Type: faultStall, Bytes: 10}, {Type: faultStall, Bytes: 10}},
+			Server, []int{4, 6, 4},
+			[]faultEvent{{10, faultStall}, {10, faultStall}},
+		},
+		{
+			"start of connection",
+			[]Fault{{Type: faultReset}},
+			Server, []int{4},
+			[]faultEvent{{0, faultReset}},
+		},
+		{
+			"other side",
+			[]Fault{{Type: faultReset, Side: "client", Bytes: 30}, {Type: faultStall, Bytes: 10}},
+			Server, []int{100},
+			[]faultEvent{{10, faultStall}},
+		},
+		{
+			"not reached",
+			[]Fault{{Type: faultReset, Bytes: 100}},
+			Server, []int{40, 40},
+			nil,
+		},
+		{
+			"triggered by time",
+			[]Fault{{Type: faultReset, After: 60000}, {Type: faultStall, Bytes: 10}},
+			Server, []int{100},
+			[]faultEvent{{10, faultStall}},
+		},
+	}
+
+	for _, test := range tests {
+		faults := &Faults{Rules: test.rules}
+		if err := faults.Load(); err != nil {
+			t.Fatal(err)
+		}
+		plan := faults.Plan(&Route{Name: "test"}, 0)
+
+		var got []faultEvent
+		var traveled int64
+	reads:
+		for _, size := range test.reads {
+			for n, fault := plan.Travel(test.role, size); ; n, fault = plan.Travel(test.role, size) {
+				traveled = traveled + int64(n)
+				size = size - n
+				if fault == nil {
+					break
+				}
+
+				got = append(got, faultEvent{traveled, fault.Type})
+				if fault.Type != faultStall { // The trip ends
+					break reads
+				}
+			}
+		}
+
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+// The choices for a connection only depend on the seed and the connection
+// number
+func TestFaultsPlanSeed(t *testing.T) {
+	faults := &Faults{Seed: 42, Refuse: 50, Rules: []Fault{
+		{Type: faultReset, Bytes: 10, Probability: 50},
+		{Type: faultStall, Bytes: 20, Probability: 50},
+		{Type: faultTruncate, Bytes: 30},
+	}}
+	if err := faults.Load(); err != nil {
+		t.Fatal(err)
+	}
+	route := &Route{Name: "test"}
+
+	choices := func(plan *FaultPlan) string {
+		s := strconv.FormatBool(plan.refused)
+		for _, fault := range plan.faults {
+			s = s + " " + fault.Type
+		}
+		return s
+	}
+
+	const connections = 32
+	var want [connections]string
+	distinct := make(map[string]bool)
+	for i := 0; i < connections; i++ {
+		plan := faults.Plan(route, i)
+		want[i] = choices(plan)
+		distinct[want[i]] = true
+
+		if n := len(plan.faults); n == 0 || plan.faults[n-1].Type != faultTruncate {
+			t.Errorf("connection %d: fault without a probability was not chosen: %s", i, want[i])
+		}
+	}
+
+	if len(distinct) < 2 {
+		t.Errorf("every connection got the same choices: %s", want[0])
+	}
+
+	// Arriving in another order changes nothing
+	for i := connections - 1; i >= 0; i-- {
+		if got := choices(faults.Plan(route, i)); got != want[i] {
+			t.Errorf("connection %d: got %s, want %s", i, got, want[i])
+		}
+	}
+
+	other := *faults
+	other.Seed = 43
+	same := 0
+	for i := 0; i < connections; i++ {
+		if choices(other.Plan(route, i)) == want[i] {
+			same++
+		}
+	}
+	if same == connections {
+		t.Error("another seed made the same choices")
+	}
+
+	if plan := (*Faults)(nil).Plan(route, 0); plan != nil || plan.Refuses() {
+		t.Errorf("route without faults got a plan")
+	}
+}
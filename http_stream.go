@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+// Body lengths returned by a HeadOp in addition to fixed lengths
+const (
+	bodyChunked    int64 = -1
+	bodyUntilClose int64 = -2
+)
+
+const (
+	streamHead = iota
+	streamBody
+	streamChunkSize
+	streamChunkData
+	streamChunkEnd
+	streamTrailer
+	streamOpaque
+)
+
+// Inspect (and optionally replace) a message header and return the length of
+// the message body that follows it
+type HeadOp func(head []byte) ([]byte, int64)
+
+type ForwardOp func(buffer []byte) error
+
+// Tracks HTTP/1.x message boundaries in one direction of a route so that each
+// message header can be inspected before it is detoured. Bytes that cannot be
+// framed are forwarded untouched.
+type HttpStream struct {
+	limit   int
+	onHead  HeadOp
+	pending []byte // Partial header, chunk size or trailer line
+	remain  int64  // Bytes left in the current body or chunk
+	state   int
+}
+
+func NewHttpStream(limit int, onHead HeadOp) *HttpStream {
+	stream := new(HttpStream)
+	stream.limit = limit
+	stream.onHead = onHead
+	stream.state = streamHead
+	return stream
+}
+
+// Stop looking for messages (e.g., once a connection switches protocols)
+func (s *HttpStream) Opaque() {
+	s.state = streamOpaque
+}
+
+func (s *HttpStream) IsOpaque() bool {
+	return s.state == streamOpaque
+}
+
+func (s *HttpStream) Write(buffer []byte, forward ForwardOp) error {
+	var err error
+
+	for len(buffer) > 0 && err == nil {
+		switch s.state {
+		case streamHead:
+			buffer, err = s.writeHead(buffer, forward)
+		case streamBody, streamChunkData, streamChunkEnd:
+			n := int64(len(buffer))
+			if n > s.remain {
+				n = s.remain
+			}
+
+			err = forward(buffer[:n])
+			buffer = buffer[n:]
+			s.remain = s.remain - n
+
+			if s.remain == 0 {
+				switch s.state {
+				case streamBody:
+					s.state = streamHead
+				case streamChunkData:
+					s.state, s.remain = streamChunkEnd, 2
+				case streamChunkEnd:
+					s.state = streamChunkSize
+				}
+			}
+		case streamChunkSize, streamTrailer:
+			buffer, err = s.writeLine(buffer, forward)
+		default:
+			err = forward(buffer)
+			buffer = nil
+		}
+	}
+
+	return err
+}
+
+func (s *HttpStream) writeHead(buffer []byte, forward ForwardOp) ([]byte, error) {
+	pending := append(s.pending, buffer...)
+	s.pending = nil
+
+	i := bytes.Index(pending, []byte(eom))
+	if i < 0 {
+		if len(pending) > s.limit {
+			logger.PrintlnDebug("HTTP message header exceeds", s.limit, "bytes: forwarding stream untouched")
+			s.Opaque()
+			return nil, forward(pending)
+		}
+
+		s.pending = pending
+		return nil, nil
+	}
+
+	head, body := s.onHead(pending[:i+len(eom)])
+
+	switch {
+	case body == bodyChunked:
+		s.state = streamChunkSize
+	case body == bodyUntilClose:
+		s.state = streamOpaque
+	case body > 0:
+		s.state, s.remain = streamBody, body
+	}
+
+	return pending[i+len(eom):], forward(head)
+}
+
+func (s *HttpStream) writeLine(buffer []byte, forward ForwardOp) ([]byte, error) {
+	pending := append(s.pending, buffer...)
+	s.pending = nil
+
+	i := bytes.IndexByte(pending, '\n')
+	if i < 0 {
+		if len(pending) > s.limit {
+			s.Opaque()
+			return nil, forward(pending)
+		}
+
+		s.pending = pending
+		return nil, nil
+	}
+
+	line := strings.TrimSpace(string(pending[:i]))
+
+	if s.state == streamTrailer {
+		if len(line) == 0 {
+			s.state = streamHead
+		}
+	} else {
+		if j := strings.Index(line, ";"); j >= 0 {
+			line = strings.TrimSpace(line[:j])
+		}
+
+		if size, err := strconv.ParseInt(line, 16, 64); err != nil || size < 0 {
+			logger.PrintlnDebug("Invalid HTTP chunk size: forwarding stream untouched")
+			s.Opaque()
+		} else if size == 0 {
+			s.state = streamTrailer
+		} else {
+			s.state, s.remain = streamChunkData, size
+		}
+	}
+
+	return pending[i+1:], forward(pending[:i+1])
+}
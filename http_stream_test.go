@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Body length of a test message header
+func testBodyLength(head []byte) int64 {
+	for _, line := range strings.Split(string(head), "\r\n") {
+		if colon := strings.Index(line, ":"); colon > 0 {
+			name, value := strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:])
+			if strings.EqualFold(name, "Transfer-Encoding") && strings.EqualFold(value, "chunked") {
+				return bodyChunked
+			} else if strings.EqualFold(name, "Content-Length") {
+				n, _ := strconv.ParseInt(value, 10, 64)
+				return n
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestHttpStreamFraming(t *testing.T) {
+	messages := []string{
+		"POST /a HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"5;ext=1\r\nhello\r\n",
+		"10\r\n\r\n\r\nnot a head\r\n\r\n",
+		"0\r\nTrailer: x\r\n\r\n",
+		"POST /b HTTP/1.1\r\nHost: b\r\nContent-Length: 4\r\n\r\n",
+		"\r\n\r\n",
+		"GET /c HTTP/1.1\r\nHost: c\r\n\r\n",
+	}
+	input := []byte(strings.Join(messages, ""))
+
+	// Every head is tagged and every other byte must travel untouched no
+	// matter how the stream is split
+	want := []byte(strings.Join(messages, ""))
+	want = bytes.Replace(want, []byte("Host: a\r\nTransfer-Encoding: chunked\r\n\r\n"), []byte("Host: a\r\nTransfer-Encoding: chunked\r\nX-Seen: 1\r\n\r\n"), 1)
+	want = bytes.Replace(want, []byte("Host: b\r\nContent-Length: 4\r\n\r\n"), []byte("Host: b\r\nContent-Length: 4\r\nX-Seen: 1\r\n\r\n"), 1)
+	want = bytes.Replace(want, []byte("Host: c\r\n\r\n"), []byte("Host: c\r\nX-Seen: 1\r\n\r\n"), 1)
+
+	for size := 1; size <= len(input); size++ {
+		var heads []string
+		stream := NewHttpStream(defaultHeadLimit, func(head []byte) ([]byte, int64) {
+			heads = append(heads, strings.SplitN(string(head), "\r\n", 2)[0])
+			return setHeader(head, "X-Seen", "1"), testBodyLength(head)
+		})
+
+		var got []byte
+		forward := func(buffer []byte) error {
+			got = append(got, buffer...)
+			return nil
+		}
+
+		for i := 0; i < len(input); i = i + size {
+			end := i + size
+			if end > len(input) {
+				end = len(input)
+			}
+			if err := stream.Write(input[i:end], forward); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("split every %d bytes: got %q, want %q", size, got, want)
+		}
+		if len(heads) != 3 || heads[0] != "POST /a HTTP/1.1" || heads[1] != "POST /b HTTP/1.1" || heads[2] != "GET /c HTTP/1.1" {
+			t.Fatalf("split every %d bytes: got heads %q", size, heads)
+		}
+		if stream.IsOpaque() {
+			t.Fatalf("split every %d bytes: stream became opaque", size)
+		}
+	}
+}
+
+func TestHttpStreamOpaque(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"oversized head", "GET / HTTP/1.1\r\nHost: " + strings.Repeat("a", 64) + "\r\n\r\n"},
+		{"bad chunk size", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nGET / HTTP/1.1\r\n\r\n"},
+	}
+
+	for _, test := range tests {
+		heads := 0
+		stream := NewHttpStream(48, func(head []byte) ([]byte, int64) {
+			heads++
+			return head, testBodyLength(head)
+		})
+
+		var got []byte
+		for i := range test.input { // Heads are only measured while incomplete
+			stream.Write([]byte(test.input[i:i+1]), func(buffer []byte) error {
+				got = append(got, buffer...)
+				return nil
+			})
+		}
+
+		if string(got) != test.input || !stream.IsOpaque() || heads > 1 {
+			t.Errorf("%s: got %q with %d heads (opaque %t)", test.name, got, heads, stream.IsOpaque())
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -13,6 +15,7 @@ import (
 	"os/signal"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -23,6 +26,7 @@ import (
 
 const _VERSION string = "0.5.0"
 
+var _capacity *Capacity
 var _guide GuideImpl
 
 type FastRoute struct {
@@ -32,20 +36,59 @@ type FastRoute struct {
 }
 
 type Route struct {
-	Bandwidth  int64    `json:"bandwidth"`  // Bits per second (max travel speed)
-	Buffersize uint64   `json:"buffersize"` // Bytes (max passengers)
-	Delay      int64    `json:"delay"`      // Milliseconds (travel delay)
-	Flow       int      `json:"flow"`       // Flow control one-way or two-way (one-way traffic will always flow from source to destination(s))
-	Guide      string   `json:"guide"`      // HTTP(S) probe to query a load balancer for backend addresses, response field name containing IP address, and static destination port
-	Inspect    bool     `json:"inspect"`    // True = proxy, false = reverse proxy
-	SpeedLimit int64    `json:"speedLimit"` // Speed control in bits per second (maximum speed limit)
-	Src        string   `json:"src"`        // Source/Point of Departure
-	Dst        []string `json:"dst"`        // Destinations
+	Bandwidth      int64         `json:"bandwidth"`      // Bits per second (max travel speed)
+	Buffersize     uint64        `json:"buffersize"`     // Bytes (max passengers)
+	Capture        *Capture      `json:"capture"`        // pcapng capture of the bytes traveling the route
+	ConnectTimeout int64         `json:"connectTimeout"` // Milliseconds (max time to connect to a destination, 0 = no limit)
+	Delay          int64         `json:"delay"`          // Milliseconds (travel delay)
+	DstAcl         *Acl          `json:"dstAcl"`         // Destinations that may or may not be traveled to
+	Faults         *Faults       `json:"faults"`         // Resets, stalls, truncation and refusals injected into connections
+	Flow           int           `json:"flow"`           // Flow control one-way or two-way (one-way traffic will always flow from source to destination(s))
+	Forwarded      bool          `json:"forwarded"`      // Add X-Forwarded-*, Forwarded and Via headers to HTTP requests in proxy mode
+	Guide          string        `json:"guide"`          // HTTP(S) probe to query a load balancer for backend addresses, response field name containing IP address, and static destination port
+	HalfCloseWait  int64         `json:"halfCloseWait"`  // Milliseconds (max time the other direction may travel after one side has half-closed, 0 = no limit)
+	HeadLimit      int           `json:"headLimit"`      // Bytes (max HTTP request header size in proxy mode)
+	HeadWait       int64         `json:"headWait"`       // Milliseconds (max time to receive an HTTP request header in proxy mode)
+	IdleTimeout    int64         `json:"idleTimeout"`    // Milliseconds (max time without traffic in either direction, 0 = no limit)
+	Inspect        bool          `json:"inspect"`        // True = proxy, false = reverse proxy
+	Lifetime       int64         `json:"lifetime"`       // Milliseconds (max time a connection may travel the route, 0 = no limit)
+	MaxConnections int           `json:"maxConnections"` // Max concurrent connections traveling the route (0 = unlimited)
+	Mirror         *Mirror       `json:"mirror"`         // Shadow backend that is also sent the bytes of sampled clients
+	Name           string        `json:"-"`              // Name of the route in the itinerary map
+	Overflow       string        `json:"overflow"`       // Connections beyond the max are closed ("close") or wait for a free seat ("queue")
+	OverflowWait   int64         `json:"overflowWait"`   // Milliseconds (max time a queued connection waits for a free seat, 0 = forever)
+	Passport       *Passport     `json:"passport"`       // Proxy credentials required to travel the route in proxy mode
+	ProxyFrom      []string      `json:"proxyFrom"`      // Load balancer addresses or CIDR ranges trusted to send a PROXY protocol header (required with proxyIn)
+	ProxyIn        bool          `json:"proxyIn"`        // Expect a PROXY protocol header from the load balancers in front of the source (other peers are taken at their word)
+	ProxyOut       string        `json:"proxyOut"`       // PROXY protocol header version ("v1" or "v2") sent to destinations
+	Recording      *Recording    `json:"recording"`      // Record the sessions traveling the route, replay their client side or mock their server side
+	Rewrite        []RewriteRule `json:"rewrite"`        // Header rewrite rules for HTTP requests and responses in proxy mode
+	Socks          bool          `json:"socks"`          // Accept SOCKS5 clients in proxy mode (detected alongside HTTP clients when inspect is also true)
+	SpeedLimit     int64         `json:"speedLimit"`     // Speed control in bits per second (maximum speed limit)
+	Src            string        `json:"src"`            // Source/Point of Departure
+	SrcAcl         *Acl          `json:"srcAcl"`         // Clients that may or may not travel the route (a client is the address announced by a trusted PROXY protocol header, otherwise the peer)
+	SrcLimit       int           `json:"srcLimit"`       // Max concurrent connections per client IP address
+	SrcRate        int           `json:"srcRate"`        // Max new connections per second per client IP address
+	Transparent    string        `json:"transparent"`    // Forward redirected connections to their original destination ("redirect" = iptables REDIRECT/DNAT, "tproxy" = iptables TPROXY)
+	Upstream       *Upstream     `json:"upstream"`       // Parent proxy that destinations are reached through
+	WebSocketLog   bool          `json:"websocketLog"`   // Log the opcode and size of WebSocket frames in proxy mode
+	Dst            []string      `json:"dst"`            // Destinations
+	live           *Conditions   // Bandwidth, delay and flow as adjusted while the route is intercepted
+	stats          *RouteStats   // Running totals kept once the route is intercepted
+	proxyFrom      []aclRule     // Load balancers trusted to announce client addresses
+	loadErr        error         // Reason the route cannot be intercepted safely
 }
 
 type Itinerary struct {
-	Map       map[string]Route `json:"map"`
-	Shortcuts []FastRoute      `json:"shortcuts"`
+	AccessLog      *AccessLog       `json:"accessLog"` // JSON lines record of every closed connection (nil = disabled)
+	Admin          string           `json:"admin"`     // Address of the admin HTTP API (e.g., "127.0.0.1:9101", empty = disabled)
+	Map            map[string]Route `json:"map"`
+	Metrics        string           `json:"metrics"`        // Address of the Prometheus /metrics endpoint (e.g., "127.0.0.1:9100", empty = disabled)
+	MaxConnections int              `json:"maxConnections"` // Max concurrent connections traveling all routes (0 = unlimited)
+	Overflow       string           `json:"overflow"`       // Connections beyond the max are closed ("close") or wait for a free seat ("queue")
+	OverflowWait   int64            `json:"overflowWait"`   // Milliseconds (max time a queued connection waits for a free seat, 0 = forever)
+	Report         *Report          `json:"report"`         // Periodic throughput reports of connections and routes (nil = disabled)
+	Shortcuts      []FastRoute      `json:"shortcuts"`
 }
 
 func sigHandler(ch *chan os.Signal) {
@@ -80,6 +123,32 @@ func main() {
 	flag.Parse()
 
 	itinerary := loadItinerary(itineraryFile)
+	_capacity = NewCapacity("Itinerary", itinerary.MaxConnections, itinerary.Overflow, itinerary.OverflowWait)
+
+	if itinerary.AccessLog != nil {
+		if err := itinerary.AccessLog.Open(); err != nil {
+			logger.PrintlnError("Failed to open access log:", err.Error())
+			os.Exit(1)
+		}
+		_accessLog = itinerary.AccessLog
+	}
+
+	if itinerary.Report != nil {
+		reporter, err := NewReporter(itinerary.Report)
+		if err != nil {
+			logger.PrintlnError("Failed to start reporting:", err.Error())
+			os.Exit(1)
+		}
+		_reporter = reporter
+	}
+
+	if len(itinerary.Admin) > 0 {
+		go serveAdmin(itinerary.Admin)
+	}
+
+	if len(itinerary.Metrics) > 0 {
+		go serveMetrics(itinerary.Metrics)
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(len(itinerary.Map))
@@ -102,6 +171,68 @@ func loadItinerary(fileName *string) Itinerary {
 
 	_guide.LoadShortcuts(itinerary.Shortcuts)
 
+	for name, m := range itinerary.Map {
+		m.Name = name
+
+		for _, acl := range []*Acl{m.DstAcl, m.SrcAcl} {
+			if acl != nil {
+				if err := acl.Load(); err != nil {
+					logger.PrintlnError(name, ":", err.Error())
+					m.loadErr = err
+				}
+			}
+		}
+
+		if m.ProxyIn {
+			var err error
+			if len(m.ProxyFrom) == 0 {
+				err = errProxyFrom
+			} else {
+				m.proxyFrom, err = parseAclRules(m.ProxyFrom)
+			}
+
+			if err != nil { // Any client could otherwise claim to be another
+				logger.PrintlnError(name, ":", err.Error())
+				m.loadErr = err
+			}
+		}
+
+		if m.Faults != nil {
+			if err := m.Faults.Load(); err != nil {
+				logger.PrintlnError(name, ":", err.Error())
+				m.loadErr = err
+			}
+		}
+
+		if m.Passport != nil {
+			if err := m.Passport.Load(); err != nil {
+				logger.PrintlnError(name, ":", err.Error())
+			}
+		}
+
+		if m.Capture != nil {
+			if err := m.Capture.Load(); err != nil {
+				logger.PrintlnError(name, ":", err.Error())
+			}
+		}
+
+		if m.Recording != nil {
+			if err := m.Recording.Load(); err != nil { // Replaying, mocking or recording nothing would pass for working
+				logger.PrintlnError(name, ":", err.Error())
+				m.loadErr = err
+			}
+		}
+
+		if m.Upstream != nil {
+			if err := m.Upstream.Load(); err != nil {
+				logger.PrintlnError(name, ":", err.Error())
+				m.loadErr = err
+			}
+		}
+
+		itinerary.Map[name] = m
+	}
+
 	logger.PrintlnInfo("Asking guides for directions")
 
 	var wg sync.WaitGroup
@@ -193,6 +324,15 @@ func askGuide(guide, key string) (string, error) {
 	return dir, err
 }
 
+func listen(route *Route) (net.Listener, error) {
+	config := net.ListenConfig{}
+	if route.Transparent == transparentTproxy {
+		config.Control = transparentControl
+	}
+
+	return config.Listen(context.Background(), "tcp", route.Src)
+}
+
 func intercept(wg *sync.WaitGroup, route Route) {
 	//ipAddr, err := net.ResolveIPAddr("ip4", route.Src)
 	//if sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP); err == nil {
@@ -201,34 +341,117 @@ func intercept(wg *sync.WaitGroup, route Route) {
 	//    syscall.Bind(sock, ipAddr)
 	//}
 
-	listener, err := net.Listen("tcp", route.Src)
+	capacity := NewCapacity("Route "+route.Name, route.MaxConnections, route.Overflow, route.OverflowWait)
+	route.live = NewConditions(&route)
+	route.stats = NewRouteStats(&route, capacity)
+
+	if route.loadErr != nil { // E.g., a rule that cannot be parsed would leave the route open to anyone
+		logger.PrintlnError("Route", route.Name, "will not be intercepted:", route.loadErr.Error())
+		route.stats.SetListenErr(route.loadErr)
+		wg.Done()
+		return
+	}
+
+	if route.Recording.Replays() { // Replayed clients arrive from the recording rather than a listener
+		route.Recording.Replay(&route)
+		wg.Done()
+		return
+	}
+
+	listener, err := listen(&route)
 
 	// Add HTTP probe functions to a map class
 	if err == nil {
 		defer listener.Close()
 		logger.PrintlnInfo("Listening on", route.Src)
-		routeCount := 0
+		go _reporter.WatchRoute(route.stats)
+		checkpoint := NewCheckpoint(&route)
+		var routeCount int64
 		for {
 			if con, err := listener.Accept(); err == nil {
-				go findRoute(con, &route, routeCount)
-				routeCount++
+				route.stats.Accept()
+				go arrive(con, &route, checkpoint, capacity, &routeCount)
 			} else {
 				logger.PrintlnError(err.Error())
 			}
 		}
 	} else {
+		route.stats.SetListenErr(err)
 		logger.PrintlnError(err.Error())
 	}
 
 	wg.Done()
 }
 
+// Admit an accepted connection onto a route and send it on its way
+func arrive(con net.Conn, route *Route, checkpoint *Checkpoint, capacity *Capacity, routeCount *int64) {
+	if route.ProxyIn && trustsProxy(route.proxyFrom, con) {
+		var err error
+		if con, err = readProxyHeader(con, headWait(route)); err != nil {
+			logger.PrintlnInfo("Refused connection from", con.RemoteAddr().String(), "on", route.Src, ":", err.Error())
+			route.stats.Refuse()
+			con.Close()
+			return
+		}
+	}
+
+	if reason, ok := checkpoint.Admit(con); !ok {
+		logger.PrintlnInfo("Refused connection from", con.RemoteAddr().String(), "on", route.Src, ":", reason)
+		route.stats.Refuse()
+		con.Close()
+		return
+	}
+	defer checkpoint.Depart(con)
+
+	if !capacity.Acquire() {
+		route.stats.Refuse()
+		con.Close()
+		return
+	}
+	defer capacity.Release()
+
+	if !_capacity.Acquire() {
+		route.stats.Refuse()
+		con.Close()
+		return
+	}
+	defer _capacity.Release()
+
+	findRoute(con, route, int(atomic.AddInt64(routeCount, 1)-1))
+}
+
 func findRoute(src net.Conn, route *Route, routeCount int) error {
 	var res error = nil
 	var mp Map = nil
+	start := time.Now()
 
-	if route.Inspect { // Proxy mode (tunnel)
+	faults := route.Faults.Plan(route, routeCount)
+	if faults.Refuses() {
+		logger.PrintlnInfo("Injecting fault: refused", src.RemoteAddr().String(), "on route", route.Name, "connection", routeCount)
+		route.stats.Refuse()
+		resetConn(src)
+		src.Close()
+		return res
+	}
+
+	// Bytes a map reads or writes while finding the destination belong to the trip
+	arrival := newArrivalConn(src)
+	src = arrival
+
+	if route.Recording.Mocks() { // Mock mode
+		mp = new(MapMock)
+	} else if route.Socks { // Proxy mode (SOCKS5 or tunnel)
+		if version, err := peekByte(&src, headWait(route)); err != nil {
+			logger.PrintlnInfo("No route found for", src.RemoteAddr().String(), ":", err.Error())
+		} else if version == socksVersion {
+			mp = new(MapSocks)
+		} else if route.Inspect {
+			mp = new(MapHttp)
+		}
+	} else if route.Inspect { // Proxy mode (tunnel)
 		mp = new(MapHttp)
+	} else if len(route.Transparent) > 0 { // Transparent proxy mode
+		mp = new(MapTransparent)
 	} else if len(route.Dst) > 0 { // Load balancer mode
 		mpTcp := new(MapTcp)
 		mpTcp.Destinations = route.Dst
@@ -236,13 +459,13 @@ func findRoute(src net.Conn, route *Route, routeCount int) error {
 	}
 
 	if mp != nil {
-		switch {
-		case route.Flow == 1:
+		switch flow := route.live.Flow(); {
+		case flow == 1:
 			mp.GetImpl().Flow = OneWay
-		case route.Flow == 2:
+		case flow == 2:
 			mp.GetImpl().Flow = TwoWay
-		case route.Flow >= 3: // Temporary/random closure
-			if (routeCount+1)%route.Flow == 0 {
+		case flow >= 3: // Temporary/random closure
+			if (routeCount+1)%flow == 0 {
 				mp.GetImpl().Flow = Closed
 			} else {
 				mp.GetImpl().Flow = TwoWay
@@ -252,14 +475,25 @@ func findRoute(src net.Conn, route *Route, routeCount int) error {
 		}
 
 		mp.GetImpl().RouteNumber = routeCount
-		if dst, err := mp.FindRoute(_guide, src); err == nil {
-			startDetour(mp.GetRouteNumber(), src, dst, route, mp)
+		mp.GetImpl().Faults = faults
+		mp.GetImpl().Route = route
+		mp.GetImpl().Mirror = route.Mirror.Open(route, src) // Before any bytes are forwarded
+		if dst, err := mp.FindRoute(_guide, src); err == nil && dst != nil {
+			startDetour(mp.GetRouteNumber(), src, dst, route, mp, arrival)
+		} else if err == nil { // Route was detoured by the map itself
+			mp.GetImpl().Mirror.Finish()
+			src.Close()
 		} else {
+			mp.GetImpl().Mirror.Finish()
+			route.stats.Fail()
 			src.Close()
 			logger.PrintlnError(err.Error())
+			_accessLog.NoRoute(src, route, mp, start, err)
 		}
 	} else {
+		route.stats.Fail()
 		src.Close()
+		_accessLog.NoRoute(src, route, nil, start, nil)
 	}
 
 	return res
@@ -268,7 +502,7 @@ func findRoute(src net.Conn, route *Route, routeCount int) error {
 func setTcpOptions(con net.Conn) {
 	//listener.SetReadBuffer(4*1024*1024)
 	//listener.SetWriteBuffer(4*1024*1024)
-	if tcpCon, ok := con.(*net.TCPConn); ok == true {
+	if tcpCon, ok := unwrapConn(con).(*net.TCPConn); ok == true {
 		tcpCon.SetNoDelay(true)
 	}
 	//t, _ := con.(*net.TCPConn)
@@ -287,29 +521,79 @@ func setTcpOptions(con net.Conn) {
 	//EnableTcpFastPath(t)
 }
 
-func startDetour(id int, src net.Conn, dst net.Conn, route *Route, mp Map) {
-	logger.PrintlnInfo("Opening route", id, ":", src.RemoteAddr().String(), "to", dst.RemoteAddr().String(), "flow is", flowText[mp.GetFlow()])
+func startDetour(id int, src net.Conn, dst net.Conn, route *Route, mp Map, arrival *arrivalConn) {
+	traveler := []interface{}{}
+	if user := mp.GetImpl().User; len(user) > 0 {
+		traveler = append(traveler, "for user", user)
+	}
+
+	trip := NewTrip(src, dst)
+	trip.dstAddr = mp.GetImpl().DstAddr
+
+	logger.PrintlnInfo(append([]interface{}{"Opening route", id, ":", src.RemoteAddr().String(), "to", trip.Destination(), "flow is", flowText[mp.GetFlow()]}, traveler...)...)
+
+	arrived := arrival.Arrive()
+	for _, chunk := range arrived {
+		if chunk.role == Client {
+			route.stats.Travel(Client, len(chunk.buffer))
+			trip.Travel(Client, len(chunk.buffer))
+		}
+	}
+
+	if _, ok := mp.GetImpl().Shortcut.(*ShortcutNull); !ok && mp.GetImpl().Shortcut != nil {
+		route.stats.TakeShortcut()
+	}
+
+	trip.Register(route, mp)
+	defer trip.Unregister()
 
 	if mp.GetFlow() != Closed {
 		setTcpOptions(src)
 		setTcpOptions(dst)
 
+		start := trip.Start
+		if len(arrived) > 0 {
+			start = arrived[0].time
+		}
+
+		trip.capture = route.Capture.Open(src, dst, start)
+		trip.recording = route.Recording.Open(trip, start)
+		for _, chunk := range arrived {
+			trip.capture.travel(chunk.role, chunk.buffer, chunk.time)
+			trip.recording.travel(chunk.role, chunk.buffer, chunk.time)
+		}
+
+		trip.mirror = mp.GetImpl().Mirror
+		mp.GetImpl().Faults.Start(trip)
+
+		go trip.Watch(time.Duration(route.IdleTimeout)*time.Millisecond, time.Duration(route.Lifetime)*time.Millisecond)
+
+		metrics := [2]*Metrics{
+			_reporter.NewMetrics("CLIENT-" + strconv.Itoa(id)),
+			_reporter.NewMetrics("SERVER-" + strconv.Itoa(id)),
+		}
+
 		var wg sync.WaitGroup
 		wg.Add(2)
 
-		go reroute(&wg, src, dst, Client, route, mp)
-		go reroute(&wg, dst, src, Server, route, mp)
+		go reroute(&wg, src, dst, Client, route, mp, trip, metrics[Client])
+		go reroute(&wg, dst, src, Server, route, mp, trip, metrics[Server])
 		wg.Wait()
+
+		metrics[Client].Summary()
+		metrics[Server].Summary()
 	} else {
-		src.Close()
-		dst.Close()
+		trip.End("flow is closed")
 	}
 
-	logger.PrintlnInfo("Closing route", id, ":", src.RemoteAddr().String(), "to", dst.RemoteAddr().String())
+	mp.GetImpl().Mirror.Finish()
+	route.stats.Finish(time.Since(trip.Start))
+	_accessLog.Trip(trip, mp)
+
+	logger.PrintlnInfo(append(append([]interface{}{"Closing route", id, ":", src.RemoteAddr().String(), "to", trip.Destination()}, traveler...), "reason is", trip.Reason())...)
 }
 
-func reroute(wg *sync.WaitGroup, src net.Conn, dst net.Conn, role Role, route *Route, mp Map) {
-	bandwidth := route.Bandwidth / 8
+func reroute(wg *sync.WaitGroup, src net.Conn, dst net.Conn, role Role, route *Route, mp Map, trip *Trip, metrics *Metrics) {
 	bufferSize := route.Buffersize
 
 	tag := ""
@@ -320,19 +604,47 @@ func reroute(wg *sync.WaitGroup, src net.Conn, dst net.Conn, role Role, route *R
 		tag = "SERVER-" + strconv.Itoa(mp.GetRouteNumber())
 	}
 
-	metrics := MetricsNew(1000*1000*1000*1000, -1, tag)
+	var tb *tokenbucket.TokenBucket
+	changes := int64(-1)
+	buf := make([]byte, bufferSize)
 
-	tbSize := uint64(bandwidth) * 10
-	if bufferSize > uint64(bandwidth) {
-		tbSize = bufferSize * 10
-	}
+	delayer := NewDelayer(func(b []byte) error {
+		mp.Detour(role, b)
+		return nil
+	})
 
-	tb := tokenbucket.New(uint64(bandwidth), tbSize)
-	buf := make([]byte, bufferSize)
-	defer src.Close()
-	defer dst.Close()
+	faults := mp.GetImpl().Faults
+
+	travel := func(b []byte) {
+		if len(b) == 0 {
+			return
+		}
+
+		// Recorded before being detoured so that the recording never has a
+		// response ahead of the request it answers
+		trip.capture.Travel(role, b)
+		trip.recording.Travel(role, b)
+
+		size := len(b)
+		if (role == Client && mp.GetFlow() == Closed) ||
+			(role == Server && mp.GetFlow() != TwoWay) {
+			logger.PrintlnDebug(tag, "flow is closed in this direction: blocking", size, "bytes")
+			route.stats.Drop(role, size)
+		} else {
+			logger.PrintlnDebug(tag, "flow is open in this direction: detouring", size, "bytes")
+			delayer.Detour(b, route.live.Delay())
+		}
+		metrics.Add(int64(size))
+		route.stats.Travel(role, size)
+		trip.Travel(role, size)
+	}
 
 	for {
+		if n := route.live.Changes(); n != changes { // The bandwidth may be adjusted while traveling
+			changes = n
+			tb = newBandwidthBucket(route.live.Bandwidth(), bufferSize)
+		}
+
 		bytes := tb.Remove(bufferSize)
 		if bytes < bufferSize {
 			tb.Return(bytes)
@@ -343,26 +655,43 @@ func reroute(wg *sync.WaitGroup, src net.Conn, dst net.Conn, role Role, route *R
 		size, err := src.Read(buf)
 
 		if err == nil {
-			if (role == Client && mp.GetFlow() == Closed) ||
-				(role == Server && mp.GetFlow() != TwoWay) {
-				logger.PrintlnDebug(tag, "flow is closed in this direction: blocking", size, "bytes")
-			} else {
-				logger.PrintlnDebug(tag, "flow is open in this direction: detouring", size, "bytes")
-				mp.Detour(role, buf[:size])
+			chunk := buf[:size]
+			for n, fault := faults.Travel(role, len(chunk)); fault != nil; n, fault = faults.Travel(role, len(chunk)) {
+				travel(chunk[:n])
+				chunk = chunk[n:]
+				delayer.Close() // Bytes before the fault arrive before it is injected
+				if !faults.Inject(fault, trip) {
+					chunk = nil
+					break
+				}
 			}
-			metrics.Add(int64(size))
+			travel(chunk)
 
 			if size < int(bufferSize) {
 				tb.Return(bufferSize - uint64(size))
 			}
 		} else {
 			logger.PrintlnInfo(tag, err.Error())
+			delayer.Close()
+			trip.capture.Finish(role, err)
+			trip.recording.Finish(role)
+			if role == Client {
+				trip.mirror.Finish()
+			}
+			if err == io.EOF && !trip.Finish(dst) {
+				logger.PrintlnDebug(tag, "half-closed: waiting for the other direction to finish")
+				if route.HalfCloseWait > 0 {
+					dst.SetReadDeadline(time.Now().Add(time.Duration(route.HalfCloseWait) * time.Millisecond))
+				}
+			} else if err == io.EOF {
+				trip.End(tag + " " + err.Error())
+			} else {
+				trip.Fail(tag+" "+err.Error(), err)
+			}
 			break
 		}
 	}
 
-	//metrics.Dump()
-
 	if wg != nil {
 		wg.Done()
 	}
@@ -29,8 +29,15 @@ type MapImpl struct {
 	Flow        Flow
 	Src         net.Conn // Arrival connection
 	Dst         net.Conn // Departure connection
+	DstAddr     string   // Destination dialed (the peer of Dst is the upstream proxy, if any)
+	Route       *Route
 	RouteNumber int
 	Shortcut    Shortcut
+	User        string        // Authenticated proxy user
+	Method      string        // Method of the HTTP request that chose the destination
+	Host        string        // Host of the HTTP request that chose the destination
+	Faults      *FaultPlan    // Faults injected into the connection
+	Mirror      *MirrorStream // Shadow backend sent a copy of the client bytes forwarded to the destination
 }
 
 type Map interface {
@@ -44,13 +51,22 @@ type Map interface {
 func (m *MapImpl) Detour(role Role, buffer []byte) {
 	switch role {
 	case Client:
+		m.Mirror.Travel(buffer)
 		m.Dst.Write(buffer)
 	case Server:
 		m.Src.Write(buffer)
 	}
 }
 
+// Adjusting the flow of a route also changes the flow of connections that are
+// already traveling it
 func (m *MapImpl) GetFlow() Flow {
+	if m.Route != nil && m.Route.live != nil {
+		if flow, ok := m.Route.live.FlowOverride(); ok {
+			return flow
+		}
+	}
+
 	return m.Flow
 }
 
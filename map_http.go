@@ -3,224 +3,517 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"io"
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/shanebarnes/goto/logger"
 	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/hpack"
 )
 
 const (
 	eom    string = "\r\n\r\n"
 	indent string = "    "
 
+	defaultHeadLimit = 64 * 1024
+	defaultHeadWait  = 10 * time.Second
+	frameHeaderLen   = 9
+	headChunkSize    = 4096
+
 	methodConnect = "CONNECT"
 
-	pseudoHdrAuth   = ":authority"
-	pseudoHdrMethod = ":method"
-	pseudoHdrPath   = ":path"
-	pseudoHdrScheme = ":scheme"
+	proxyAuthorization = "Proxy-Authorization"
+)
+
+var (
+	errBadAddress     = errors.New("invalid destination address")
+	errHeadIncomplete = errors.New("incomplete HTTP request header")
+	errHeadMalformed  = errors.New("malformed HTTP request header")
+	errHeadTooLarge   = errors.New("HTTP request header too large")
 )
 
 type MapHttp struct {
-	Impl MapImpl
+	Impl     MapImpl
+	mutex    sync.Mutex
+	requests []*http.Request // Requests waiting for a response
+	streams  [2]*HttpStream
+	taps     [2]*WebSocketTap
+	upgraded int32 // Non-zero once the connection has switched protocols
 }
 
 func (m *MapHttp) createDstConn(guide GuideImpl, src net.Conn, hostPort, userAgent string) (net.Conn, error) {
-	dst, err := net.Dial("tcp", hostPort)
+	dst, dstAddr, err := dialDestination(m.Impl.Route, src, hostPort)
 
 	if err == nil {
 		m.Impl.Shortcut = guide.FindShortcut(m.GetRouteNumber(), Client, userAgent, src, dst)
 		m.Impl.Src = src
 		m.Impl.Dst = dst
+		m.Impl.DstAddr = dstAddr
 	}
 
 	return dst, err
 }
 
-func (m *MapHttp) findHttp1Route(guide GuideImpl, src net.Conn, buf *bytes.Buffer) (string, net.Conn, error) {
+func (m *MapHttp) findHttp1Route(guide GuideImpl, src net.Conn, head []byte) (string, net.Conn, error) {
 	var dst net.Conn
-	var addr string
+	var addr, method string
 	var err error
 	var request *http.Request
 
-	reader := bufio.NewReader(strings.NewReader(string(buf.Bytes())))
+	reader := bufio.NewReader(bytes.NewReader(head))
 	if request, err = http.ReadRequest(reader); err == nil {
-		logger.PrintlnInfo("Found a", request.Proto, "route for a", request.Method, "request to", request.RequestURI)
+		method = request.Method
+		m.Impl.Method = request.Method
+		m.Impl.Host = request.Host
 
-		if request.Method == methodConnect {
-			addr = request.RequestURI
+		if isH2cUpgrade(request) {
+			return method, nil, m.serveHttp2(guide, src, head)
+		}
 
-			body := ""
-			hdr := make(http.Header, 0)
-			hdr.Add("X-Detour-Version", _VERSION)
-
-			rsp := &http.Response{
-				Status:        "200 OK",
-				StatusCode:    http.StatusOK,
-				Proto:         "HTTP/1.1",
-				ProtoMajor:    1,
-				ProtoMinor:    1,
-				Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
-				ContentLength: int64(len(body)),
-				Request:       nil,
-				Header:        hdr,
+		if passport := m.passport(); passport != nil {
+			if m.Impl.User, err = passport.Check(request.Header.Get(proxyAuthorization)); err != nil {
+				logger.PrintlnInfo("Refused a", request.Method, "request to", request.RequestURI, "from", src.RemoteAddr().String(), ":", err.Error())
+				return method, nil, err
 			}
-			rspBuf := bytes.NewBuffer(nil)
-			rsp.Write(rspBuf)
-			src.Write(rspBuf.Bytes())
-		} else {
-			url, err := url.Parse(request.RequestURI)
+		}
 
-			if err == nil {
-				//if request.ProtoAtLeast(2, 0) {
-				//}
+		logger.PrintlnInfo("Found a", request.Proto, "route for a", request.Method, "request to", request.RequestURI)
 
-				if strings.ContainsAny(url.Host, ":") {
+		if request.Method == methodConnect {
+			addr = request.RequestURI
+		} else if url, e := url.Parse(request.RequestURI); e == nil {
+			if strings.ContainsAny(url.Host, ":") {
+				addr = url.Host
+			} else {
+				switch url.Scheme {
+				case "http":
+					addr = url.Host + ":80"
+				case "https":
+					addr = url.Host + ":443"
+				default:
 					addr = url.Host
-				} else {
-					switch url.Scheme {
-					case "http":
-						addr = url.Host + ":80"
-					case "https":
-						addr = url.Host + ":443"
-					default:
-						addr = url.Host
-					}
 				}
-			} else {
-				logger.PrintlnError(err.Error())
 			}
+		} else {
+			logger.PrintlnError(e.Error())
 		}
 
-		dst, err = m.createDstConn(guide, src, addr, request.UserAgent())
+		if host, _, e := net.SplitHostPort(addr); e != nil || len(host) == 0 {
+			err = errBadAddress
+		} else if dst, err = m.createDstConn(guide, src, addr, request.UserAgent()); err == nil && method == methodConnect {
+			// Only confirm the tunnel once the destination is reachable
+			err = writeHttpResponse(src, http.StatusOK, nil)
+		}
 	} else {
 		logger.PrintlnInfo("connect error: ", err)
+		err = errHeadMalformed
 	}
 
-	return request.Method, dst, err
+	return method, dst, err
 }
 
-// Test: export http_proxy=<host>:<port>; curl -I --http2 --http2-prior-knowledge http://www.google.com/
-func (m *MapHttp) findHttp2Route(guide GuideImpl, src net.Conn, buf *bytes.Buffer) (string, net.Conn, error) {
-	var method string
+func (m *MapHttp) FindRoute(guide GuideImpl, src net.Conn) (net.Conn, error) {
 	var dst net.Conn
-	var err error
+	var method string
 
-	prefaceLen := len(http2.ClientPreface)
-
-	if buf.Len() < prefaceLen {
-		err = syscall.EPROTONOSUPPORT // HTTP/2.0 protocol not supported since client preface requires 24 bytes
-	} else if strings.HasPrefix(string(buf.Bytes()[:prefaceLen]), http2.ClientPreface) {
-		buf.Next(prefaceLen)
-		frameReader := http2.NewFramer(ioutil.Discard, buf)
-
-		var frame http2.Frame
-		var addr, authority, path, scheme string
-		decoder := hpack.NewDecoder(2048, nil)
-		for err == nil {
-			frame, err = frameReader.ReadFrame()
-
-			if err == nil {
-				switch f := frame.(type) {
-				case *http2.SettingsFrame:
-					logger.PrintlnDebug("settings:")
-					f.ForeachSetting(func(s http2.Setting) error {
-						logger.PrintlnDebug(indent, s.ID, "=", s.Val)
-						return nil
-					})
-				case *http2.WindowUpdateFrame:
-					logger.PrintlnDebug("window update:")
-					logger.PrintlnDebug(indent, "increment", "=", f.Increment)
-				case *http2.HeadersFrame:
-					logger.PrintlnDebug("headers:")
-					hf, _ := decoder.DecodeFull(f.HeaderBlockFragment())
-					for _, h := range hf {
-						switch h.Name {
-						case pseudoHdrAuth:
-							authority = h.Value
-						case pseudoHdrMethod:
-							method = h.Value
-						case pseudoHdrPath:
-							path = h.Value
-						case pseudoHdrScheme:
-							scheme = h.Value
-						}
-						logger.PrintlnDebug(indent, h.Name, "=", h.Value)
-					}
-				default:
-					logger.PrintlnDebug("frame:", f)
+	head, err := m.readHead(src)
+	if err == nil {
+		logger.PrintlnDebug("Read", len(head), "bytes")
+
+		if isHttp2Preface(head) {
+			err = m.serveHttp2(guide, src, head)
+		} else if method, dst, err = m.findHttp1Route(guide, src, head); err != nil && dst == nil {
+			m.writeHttpError(src, err)
+		}
+
+		if err == nil && dst != nil { // Demultiplexed HTTP/2.0 streams have no destination
+			if method != methodConnect {
+				// Only forward original request if not a CONNECT request
+				m.inspect()
+				err = m.detour(Client, head)
+			} else if n := bytes.Index(head, []byte(eom)) + len(eom); n < len(head) {
+				// Forward any data sent ahead of the CONNECT response
+				m.Impl.Mirror.Travel(head[n:])
+				_, err = m.Impl.Shortcut.Take(Client, head[n:])
+			}
+		}
+	} else if len(head) > 0 && !isHttp2Preface(head) {
+		m.writeHttpError(src, err)
+	}
+
+	return dst, err
+}
+
+// Read until an entire HTTP/1.x request header or an HTTP/2.0 client preface
+// followed by a complete HEADERS frame has arrived
+func (m *MapHttp) readHead(src net.Conn) ([]byte, error) {
+	limit := m.headLimit()
+
+	src.SetReadDeadline(time.Now().Add(headWait(m.Impl.Route)))
+	defer src.SetReadDeadline(time.Time{})
+
+	buf := bytes.NewBuffer(make([]byte, 0, headChunkSize))
+	b := make([]byte, headChunkSize)
+
+	for {
+		size, err := src.Read(b)
+		buf.Write(b[:size])
+
+		if n := headLength(buf.Bytes()); n > limit || (n == 0 && buf.Len() >= limit) {
+			return buf.Bytes(), errHeadTooLarge
+		} else if n > 0 {
+			return buf.Bytes(), nil
+		} else if err != nil {
+			return buf.Bytes(), errHeadIncomplete
+		}
+	}
+}
+
+func (m *MapHttp) headLimit() int {
+	if route := m.Impl.Route; route != nil && route.HeadLimit > 0 {
+		return route.HeadLimit
+	}
+
+	return defaultHeadLimit
+}
+
+// Max time a client may take to say where it is going
+func headWait(route *Route) time.Duration {
+	if route != nil && route.HeadWait > 0 {
+		return time.Duration(route.HeadWait) * time.Millisecond
+	}
+
+	return defaultHeadWait
+}
+
+// Return the length of the request header or 0 if it is incomplete
+func headLength(buf []byte) int {
+	n := 0
+
+	if isHttp2Preface(buf) {
+		if len(buf) >= len(http2.ClientPreface) {
+			for i := len(http2.ClientPreface); i+frameHeaderLen <= len(buf); {
+				frameLen := frameHeaderLen + (int(buf[i])<<16 | int(buf[i+1])<<8 | int(buf[i+2]))
+				frameType := http2.FrameType(buf[i+3])
+				frameFlags := http2.Flags(buf[i+4])
+
+				if i+frameLen > len(buf) {
+					break
+				}
+
+				i += frameLen
+
+				if (frameType == http2.FrameHeaders || frameType == http2.FrameContinuation) && frameFlags.Has(http2.FlagHeadersEndHeaders) {
+					n = i
+					break
 				}
-			} else if err != io.EOF {
-				logger.PrintlnError("Failed to read HTTP/2.0 frame:", err)
 			}
 		}
+	} else if i := bytes.Index(buf, []byte(eom)); i >= 0 {
+		n = i + len(eom)
+	}
+
+	return n
+}
+
+// Append a field to a raw HTTP/1.x message header
+func addHeader(head []byte, name, value string) []byte {
+	end := bytes.Index(head, []byte(eom))
+	if end < 0 {
+		return head
+	}
+
+	added := make([]byte, 0, len(head)+len(name)+len(value)+4)
+	added = append(added, head[:end+2]...)
+	added = append(added, name+": "+value+"\r\n"...)
+
+	return append(added, head[end+2:]...)
+}
+
+// Replace every occurrence of a field in a raw HTTP/1.x message header
+func setHeader(head []byte, name, value string) []byte {
+	return addHeader(stripHeader(head, name), name, value)
+}
+
+// Remove every occurrence of a field from a raw HTTP/1.x message header
+func stripHeader(head []byte, name string) []byte {
+	end := bytes.Index(head, []byte(eom))
+	if end < 0 {
+		return head
+	}
+
+	stripped := make([]byte, 0, len(head))
+	for i, line := range bytes.SplitAfter(head[:end+2], []byte("\r\n")) {
+		if colon := bytes.IndexByte(line, ':'); i > 0 && colon > 0 && strings.EqualFold(string(bytes.TrimSpace(line[:colon])), name) {
+			continue
+		}
+		stripped = append(stripped, line...)
+	}
 
-		if err == nil || err == io.EOF {
-			logger.PrintlnInfo("Found a HTTP/2.0 route for a", method, "request to", path)
+	return append(stripped, head[end+2:]...)
+}
 
-			if _, _, err = net.SplitHostPort(authority); err == nil {
-				addr = authority
-			} else if scheme == "http" {
-				addr = authority + ":80"
-			} else if scheme == "https" {
-				addr = authority + ":443"
+// Check if the buffer contains (or is the start of) an HTTP/2.0 client preface
+func isHttp2Preface(buf []byte) bool {
+	preface := []byte(http2.ClientPreface)
+
+	if len(buf) < len(preface) {
+		return bytes.HasPrefix(preface, buf)
+	}
+
+	return bytes.HasPrefix(buf, preface)
+}
+
+// Map a routing failure to the status code that best describes it
+func httpErrorStatus(err error) int {
+	status := http.StatusBadGateway
+
+	switch err {
+	case errBadAddress, errHeadIncomplete, errHeadMalformed:
+		status = http.StatusBadRequest
+	case errHeadTooLarge:
+		status = http.StatusRequestHeaderFieldsTooLarge
+	case errAclDenied:
+		status = http.StatusForbidden
+	case errProxyAuth:
+		status = http.StatusProxyAuthRequired
+	default:
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			status = http.StatusGatewayTimeout
+		}
+	}
+
+	return status
+}
+
+func (m *MapHttp) writeHttpError(con net.Conn, err error) error {
+	hdr := make(http.Header, 0)
+	hdr.Add("X-Detour-Error", err.Error())
+	if passport := m.passport(); passport != nil && err == errProxyAuth {
+		hdr.Add("Proxy-Authenticate", passport.Challenge())
+	}
+
+	return writeHttpResponse(con, httpErrorStatus(err), hdr)
+}
+
+func writeHttpResponse(con net.Conn, status int, hdr http.Header) error {
+	if hdr == nil {
+		hdr = make(http.Header, 0)
+	}
+	hdr.Add("X-Detour-Version", _VERSION)
+
+	body := ""
+	rsp := &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       nil,
+		Header:        hdr,
+	}
+	rspBuf := bytes.NewBuffer(nil)
+	rsp.Write(rspBuf)
+	_, err := con.Write(rspBuf.Bytes())
+
+	return err
+}
+
+func (m *MapHttp) Detour(role Role, buffer []byte) {
+	m.detour(role, buffer)
+}
+
+func (m *MapHttp) detour(role Role, buffer []byte) error {
+	// Switched protocols are opaque to shortcuts. Every byte after the switch
+	// reaches the tap, including any sent along with the switching response.
+	forward := func(b []byte) error {
+		if atomic.LoadInt32(&m.upgraded) != 0 {
+			if tap := m.taps[role]; tap != nil {
+				tap.Write(b)
 			}
+			m.Impl.Detour(role, b)
+			return nil
+		}
 
-			dst, err = m.createDstConn(guide, src, addr, "user-agent")
+		if role == Client { // The shadow backend sees what the destination sees
+			m.Impl.Mirror.Travel(b)
 		}
-	} else {
-		err = syscall.ENOPROTOOPT // HTTP/2.0 protocol not available
+		_, err := m.Impl.Shortcut.Take(role, b)
+		return err
 	}
 
-	return method, dst, err
+	if stream := m.streams[role]; stream != nil && atomic.LoadInt32(&m.upgraded) == 0 {
+		return stream.Write(buffer, forward)
+	}
+
+	return forward(buffer)
 }
 
-func (m *MapHttp) FindRoute(guide GuideImpl, src net.Conn) (net.Conn, error) {
-	var err error
-	var dst net.Conn
-	var method string
+// Follow the HTTP/1.x messages traveling in both directions of the route
+func (m *MapHttp) inspect() {
+	m.streams[Client] = NewHttpStream(m.headLimit(), m.onRequestHead)
+	m.streams[Server] = NewHttpStream(m.headLimit(), m.onResponseHead)
+}
 
-	b := make([]byte, 64*1024*1024)
-	buf := bytes.NewBuffer(make([]byte, 0))
-	size := 0
+func (m *MapHttp) switchProtocols(response *http.Response, head []byte) {
+	protocol := response.Header.Get("Upgrade")
+	logger.PrintlnInfo("{", m.GetRouteNumber(), "}", "Switched to", protocol, "protocol: forwarding opaque bytes")
 
-	// Assume one read will include entire HTTP header
-	if size, err = src.Read(b); err == nil {
-		buf.Write(b[:size])
-		logger.PrintlnDebug("Read", buf.Len(), "bytes")
+	if route := m.Impl.Route; route != nil && route.WebSocketLog && strings.EqualFold(protocol, "websocket") {
+		number := "{R" + strconv.Itoa(m.GetRouteNumber()) + "}"
+		m.taps[Client] = NewWebSocketTap(number + " [CLIENT]")
+		m.taps[Server] = NewWebSocketTap(number + " [SERVER]")
+		m.taps[Server].Skip(len(head)) // Forwarded once the switch is made
+	}
+
+	atomic.StoreInt32(&m.upgraded, 1)
+}
+
+func (m *MapHttp) onRequestHead(head []byte) ([]byte, int64) {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		logger.PrintlnDebug("Failed to parse HTTP request header:", err)
+		return head, bodyUntilClose
+	}
 
-		if method, dst, err = m.findHttp2Route(guide, src, buf); err != nil {
-			method, dst, err = m.findHttp1Route(guide, src, buf)
+	m.mutex.Lock()
+	m.requests = append(m.requests, request)
+	m.mutex.Unlock()
+
+	if m.passport() != nil {
+		head = stripHeader(head, proxyAuthorization)
+	}
+
+	if route := m.Impl.Route; route != nil {
+		if route.Forwarded {
+			head = m.addForwardedHeaders(request, head)
 		}
+		head = rewriteHead(route.Rewrite, Client, request, head)
+	}
 
-		// Only forward original request if not a CONNECT request
-		if err == nil && method != methodConnect {
-			_, err = m.Impl.Shortcut.Take(Client, b[:size])
+	switch {
+	case isChunked(request.TransferEncoding):
+		return head, bodyChunked
+	case request.ContentLength > 0:
+		return head, request.ContentLength
+	}
+
+	return head, 0
+}
+
+func (m *MapHttp) onResponseHead(head []byte) ([]byte, int64) {
+	var request *http.Request
+
+	m.mutex.Lock()
+	if len(m.requests) > 0 {
+		request = m.requests[0]
+	}
+	m.mutex.Unlock()
+
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), request)
+	if err != nil {
+		logger.PrintlnDebug("Failed to parse HTTP response header:", err)
+		return head, bodyUntilClose
+	}
+
+	if response.StatusCode >= 100 && response.StatusCode < 200 && response.StatusCode != http.StatusSwitchingProtocols {
+		return head, 0 // Informational responses precede the final response
+	}
+
+	m.mutex.Lock()
+	if len(m.requests) > 0 {
+		m.requests = m.requests[1:]
+	}
+	m.mutex.Unlock()
+
+	if route := m.Impl.Route; route != nil {
+		head = rewriteHead(route.Rewrite, Server, request, head)
+	}
+
+	switch {
+	case response.StatusCode == http.StatusSwitchingProtocols:
+		m.switchProtocols(response, head)
+		return head, bodyUntilClose
+	case request != nil && request.Method == http.MethodHead,
+		response.StatusCode == http.StatusNoContent,
+		response.StatusCode == http.StatusNotModified:
+		return head, 0
+	case isChunked(response.TransferEncoding):
+		return head, bodyChunked
+	case response.ContentLength >= 0:
+		return head, response.ContentLength
+	}
+
+	return head, bodyUntilClose
+}
+
+// Tell the destination who the request was made by and who it passed through
+func (m *MapHttp) addForwardedHeaders(request *http.Request, head []byte) []byte {
+	client := "unknown"
+	if m.Impl.Src != nil {
+		if ip := remoteIP(m.Impl.Src); ip != nil {
+			client = ip.String()
 		}
 	}
 
-	return dst, err
+	proto := "http"
+	if len(request.URL.Scheme) > 0 {
+		proto = strings.ToLower(request.URL.Scheme)
+	}
+
+	forwardedFor := client
+	if strings.Contains(client, ":") {
+		forwardedFor = "\"[" + client + "]\""
+	}
+
+	head = setHeader(head, "X-Forwarded-For", joinHeader(request.Header["X-Forwarded-For"], client))
+	head = setHeader(head, "Forwarded", joinHeader(request.Header["Forwarded"], "for="+forwardedFor+";host=\""+request.Host+"\";proto="+proto))
+	head = setHeader(head, "Via", joinHeader(request.Header["Via"], strconv.Itoa(request.ProtoMajor)+"."+strconv.Itoa(request.ProtoMinor)+" detour/"+_VERSION))
+
+	if len(request.Header.Get("X-Forwarded-Proto")) == 0 {
+		head = addHeader(head, "X-Forwarded-Proto", proto)
+	}
+
+	if len(request.Header.Get("X-Forwarded-Host")) == 0 {
+		head = addHeader(head, "X-Forwarded-Host", request.Host)
+	}
+
+	return head
 }
 
-func (m *MapHttp) Detour(role Role, buffer []byte) {
-	m.Impl.Shortcut.Take(role, buffer)
+func joinHeader(values []string, value string) string {
+	return strings.Join(append(append([]string{}, values...), value), ", ")
+}
+
+func isChunked(transferEncoding []string) bool {
+	return len(transferEncoding) > 0 && strings.EqualFold(transferEncoding[len(transferEncoding)-1], "chunked")
 }
 
 func (m *MapHttp) GetFlow() Flow {
-	return m.Impl.Flow
+	return m.Impl.GetFlow()
 }
 
 func (m *MapHttp) GetImpl() *MapImpl {
 	return &m.Impl
 }
 
+func (m *MapHttp) passport() *Passport {
+	if m.Impl.Route != nil {
+		return m.Impl.Route.Passport
+	}
+
+	return nil
+}
+
 func (m *MapHttp) GetRouteNumber() int {
 	return m.Impl.GetRouteNumber()
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var errListenerDone = errors.New("listener connection is closed")
+
+// Hop-by-hop headers that must not be forwarded between connections
+var hopHeaders = []string{
+	"Connection",
+	"Http2-Settings",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Replays bytes that were already read from a connection
+type prefixConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *prefixConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Read the first byte of a connection without consuming it
+func peekByte(con *net.Conn, wait time.Duration) (byte, error) {
+	b := make([]byte, 1)
+
+	(*con).SetReadDeadline(time.Now().Add(wait))
+	_, err := io.ReadFull(*con, b)
+	(*con).SetReadDeadline(time.Time{})
+
+	if err == nil {
+		*con = &prefixConn{Conn: *con, reader: io.MultiReader(bytes.NewReader(b), *con)}
+	}
+
+	return b[0], err
+}
+
+// Presents a demultiplexed stream as if it arrived on the client connection
+type streamConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Hands out a single connection and stops accepting once it is closed
+type connListener struct {
+	con  net.Conn
+	done chan struct{}
+	once sync.Once
+	used bool
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if !l.used {
+		l.used = true
+		return &listenerConn{Conn: l.con, listener: l}, nil
+	}
+
+	<-l.done
+	return nil, errListenerDone
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.con.LocalAddr()
+}
+
+type listenerConn struct {
+	net.Conn
+	listener *connListener
+}
+
+func (c *listenerConn) Close() error {
+	c.listener.Close()
+	return c.Conn.Close()
+}
+
+func isH2cUpgrade(request *http.Request) bool {
+	return strings.EqualFold(request.Header.Get("Upgrade"), "h2c") &&
+		len(request.Header.Get("HTTP2-Settings")) > 0
+}
+
+// Test: export http_proxy=<host>:<port>; curl -I --http2 --http2-prior-knowledge http://www.google.com/
+// Test: export http_proxy=<host>:<port>; curl -I --http2 http://www.google.com/
+func (m *MapHttp) serveHttp2(guide GuideImpl, src net.Conn, head []byte) error {
+	stopArriving(src) // Every stream is a trip of its own
+
+	con := &prefixConn{Conn: src, reader: io.MultiReader(bytes.NewReader(head), src)}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.detourHttp2Stream(guide, src, w, r)
+	})
+
+	if isHttp2Preface(head) {
+		logger.PrintlnInfo("Found a HTTP/2.0 route with prior knowledge")
+		new(http2.Server).ServeConn(con, &http2.ServeConnOpts{Handler: handler})
+	} else {
+		logger.PrintlnInfo("Found a HTTP/2.0 route with an upgrade request")
+		listener := &connListener{con: con, done: make(chan struct{})}
+		server := &http.Server{Handler: h2c.NewHandler(handler, new(http2.Server))}
+		server.Serve(listener)
+	}
+
+	return nil
+}
+
+// Each stream is detoured as a separate HTTP/1.1 route so that flow control
+// and shortcuts apply to every request on the HTTP/2.0 connection
+func (m *MapHttp) detourHttp2Stream(guide GuideImpl, src net.Conn, w http.ResponseWriter, r *http.Request) {
+	logger.PrintlnInfo("Found a", r.Proto, "route for a", r.Method, "request to", r.Host+r.URL.RequestURI())
+
+	if r.Method == methodConnect {
+		w.Header().Set("X-Detour-Error", "CONNECT is not supported on HTTP/2.0 streams")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	stream := new(MapHttp)
+	stream.Impl.Flow = m.Impl.Flow
+	stream.Impl.Route = m.Impl.Route
+	stream.Impl.RouteNumber = m.Impl.RouteNumber
+	stream.Impl.Method = r.Method
+	stream.Impl.Host = r.Host
+
+	if passport := m.passport(); passport != nil {
+		var err error
+		if stream.Impl.User, err = passport.Check(r.Header.Get(proxyAuthorization)); err != nil {
+			logger.PrintlnInfo("Refused a", r.Method, "request to", r.Host, "from", src.RemoteAddr().String(), ":", err.Error())
+			w.Header().Set("Proxy-Authenticate", passport.Challenge())
+			writeHttp2Error(w, err)
+			return
+		}
+		r.Header.Del(proxyAuthorization)
+	}
+
+	addr := r.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = addr + ":80"
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err != nil || len(host) == 0 {
+		writeHttp2Error(w, errBadAddress)
+		return
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	streamSrc := &streamConn{Conn: remote, remote: src.RemoteAddr(), local: src.LocalAddr()}
+
+	dst, err := stream.createDstConn(guide, streamSrc, addr, r.UserAgent())
+	if err != nil {
+		logger.PrintlnError(err.Error())
+		remote.Close()
+		writeHttp2Error(w, err)
+		return
+	}
+
+	stream.inspect()
+	stream.Impl.Mirror = stream.Impl.Route.Mirror.Open(stream.Impl.Route, streamSrc)
+	go startDetour(stream.GetRouteNumber(), streamSrc, dst, stream.Impl.Route, stream, nil)
+
+	go func() {
+		r.Close = true
+		if err := r.Write(local); err != nil {
+			local.Close()
+		}
+	}()
+
+	reader := bufio.NewReader(local)
+	rsp, err := http.ReadResponse(reader, r)
+	for err == nil && rsp.StatusCode >= 100 && rsp.StatusCode < 200 {
+		rsp, err = http.ReadResponse(reader, r)
+	}
+
+	if err != nil {
+		logger.PrintlnError(err.Error())
+		writeHttp2Error(w, err)
+		return
+	}
+	defer rsp.Body.Close()
+
+	copyHeader(w.Header(), rsp.Header)
+	w.WriteHeader(rsp.StatusCode)
+
+	buf := make([]byte, headChunkSize)
+	for {
+		size, err := rsp.Body.Read(buf)
+		if size > 0 {
+			w.Write(buf[:size])
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+}
+
+func writeHttp2Error(w http.ResponseWriter, err error) {
+	w.Header().Set("X-Detour-Error", err.Error())
+	w.Header().Set("X-Detour-Version", _VERSION)
+	w.WriteHeader(httpErrorStatus(err))
+}
+
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = append(dst[key], values...)
+	}
+
+	for _, key := range hopHeaders {
+		dst.Del(key)
+	}
+}
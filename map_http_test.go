@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestSetHeader(t *testing.T) {
+	head := []byte("GET / HTTP/1.1\r\nHost: a\r\nvia: 1.0 old\r\nAccept: */*\r\nVia : 1.1 older\r\n\r\nbody")
+
+	stripped := string(stripHeader(head, "Via"))
+	if want := "GET / HTTP/1.1\r\nHost: a\r\nAccept: */*\r\n\r\nbody"; stripped != want {
+		t.Errorf("stripped: got %q, want %q", stripped, want)
+	}
+
+	set := string(setHeader(head, "Via", "1.1 detour"))
+	if want := "GET / HTTP/1.1\r\nHost: a\r\nAccept: */*\r\nVia: 1.1 detour\r\n\r\nbody"; set != want {
+		t.Errorf("set: got %q, want %q", set, want)
+	}
+
+	// The request line is never a field and an incomplete header is left alone
+	if got := string(stripHeader([]byte("Via: / HTTP/1.1\r\n\r\n"), "Via")); got != "Via: / HTTP/1.1\r\n\r\n" {
+		t.Errorf("request line was stripped: %q", got)
+	}
+	if got := string(setHeader([]byte("GET / HTTP/1.1\r\nHost: a\r\n"), "Via", "1.1 detour")); got != "GET / HTTP/1.1\r\nHost: a\r\n" {
+		t.Errorf("incomplete header was changed: %q", got)
+	}
+}
@@ -0,0 +1,50 @@
+package main // Mock destinations that serve the server side of recorded sessions
+
+import (
+	"net"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+type MapMock struct {
+	Impl MapImpl
+}
+
+func (m *MapMock) FindRoute(guide GuideImpl, src net.Conn) (net.Conn, error) {
+	recording := m.Impl.Route.Recording
+	session := recording.nextSession()
+
+	dst, player, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.PrintlnInfo("Serving recorded session", session.open.Session, "to", src.RemoteAddr().String())
+
+	go func() {
+		sent, received, _ := recording.play(player, session, Server)
+		logger.PrintlnDebug("Served recorded session", session.open.Session, ": sent", sent, "bytes, received", received, "of", session.bytes[Client], "bytes")
+	}()
+
+	m.Impl.Src = src
+	m.Impl.Dst = &replayConn{Conn: dst, remote: recordedAddr(session.open.Server)}
+	m.Impl.DstAddr = session.open.Server
+
+	return m.Impl.Dst, nil
+}
+
+func (m *MapMock) Detour(role Role, buffer []byte) {
+	m.Impl.Detour(role, buffer)
+}
+
+func (m *MapMock) GetFlow() Flow {
+	return m.Impl.GetFlow()
+}
+
+func (m *MapMock) GetImpl() *MapImpl {
+	return &m.Impl
+}
+
+func (m *MapMock) GetRouteNumber() int {
+	return m.Impl.GetRouteNumber()
+}
@@ -0,0 +1,331 @@
+package main // SOCKS5 proxy mode (RFC 1928, RFC 1929)
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	socksVersion     = 0x05
+	socksAuthVersion = 0x01
+
+	socksMethodNone     = 0x00
+	socksMethodPassword = 0x02
+	socksMethodRefused  = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUdpAssociate = 0x03
+
+	socksAtypIpv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIpv6   = 0x04
+
+	socksReplySucceeded          = 0x00
+	socksReplyFailure            = 0x01
+	socksReplyNotAllowed         = 0x02
+	socksReplyNetUnreachable     = 0x03
+	socksReplyHostUnreachable    = 0x04
+	socksReplyRefused            = 0x05
+	socksReplyTtlExpired         = 0x06
+	socksReplyCmdUnsupported     = 0x07
+	socksReplyAddressUnsupported = 0x08
+)
+
+var (
+	errSocksAddress = errors.New("unsupported SOCKS address type")
+	errSocksCommand = errors.New("unsupported SOCKS command")
+	errSocksMethod  = errors.New("no acceptable SOCKS authentication method")
+	errSocksVersion = errors.New("unsupported SOCKS version")
+)
+
+var socksReplyText = map[byte]string{
+	socksReplyFailure:            "general failure",
+	socksReplyNotAllowed:         "connection not allowed",
+	socksReplyNetUnreachable:     "network unreachable",
+	socksReplyHostUnreachable:    "host unreachable",
+	socksReplyRefused:            "connection refused",
+	socksReplyTtlExpired:         "TTL expired",
+	socksReplyCmdUnsupported:     "command not supported",
+	socksReplyAddressUnsupported: "address type not supported",
+}
+
+// A failure reported by another SOCKS server
+type socksReplyError byte
+
+func (e socksReplyError) Error() string {
+	text, ok := socksReplyText[byte(e)]
+	if !ok {
+		text = "reply " + strconv.Itoa(int(e))
+	}
+
+	return "SOCKS server failure: " + text
+}
+
+type MapSocks struct {
+	Impl MapImpl
+}
+
+// Test: curl --socks5-hostname <host>:<port> http://www.google.com/
+func (m *MapSocks) FindRoute(guide GuideImpl, src net.Conn) (net.Conn, error) {
+	src.SetDeadline(time.Now().Add(headWait(m.Impl.Route)))
+
+	cmd, addr, err := m.readRequest(src)
+	if err != nil {
+		src.SetDeadline(time.Time{})
+		return nil, err
+	}
+
+	src.SetDeadline(time.Time{})
+
+	switch cmd {
+	case socksCmdConnect:
+		logger.PrintlnInfo("Found a SOCKS5 route to", addr)
+
+		dst, dstAddr, err := dialDestination(m.Impl.Route, src, addr)
+		if err != nil {
+			writeSocksReply(src, socksReplyCode(err), nil)
+			return nil, err
+		}
+
+		if err = writeSocksReply(src, socksReplySucceeded, dst.LocalAddr()); err != nil {
+			dst.Close()
+			return nil, err
+		}
+
+		m.Impl.Shortcut = guide.FindShortcut(m.GetRouteNumber(), Client, "", src, dst)
+		m.Impl.Src = src
+		m.Impl.Dst = dst
+		m.Impl.DstAddr = dstAddr
+
+		return dst, nil
+	case socksCmdUdpAssociate:
+		return nil, m.associate(src, addr)
+	default:
+		writeSocksReply(src, socksReplyCmdUnsupported, nil)
+		return nil, errSocksCommand
+	}
+}
+
+// Negotiate authentication and return the requested command and address
+func (m *MapSocks) readRequest(src net.Conn) (byte, string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(src, hdr); err != nil {
+		return 0, "", err
+	} else if hdr[0] != socksVersion {
+		return 0, "", errSocksVersion
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(src, methods); err != nil {
+		return 0, "", err
+	}
+
+	method := byte(socksMethodNone)
+	if m.passport() != nil {
+		method = socksMethodPassword
+	}
+
+	offered := false
+	for _, b := range methods {
+		offered = offered || b == method
+	}
+
+	if !offered {
+		src.Write([]byte{socksVersion, socksMethodRefused})
+		return 0, "", errSocksMethod
+	} else if _, err := src.Write([]byte{socksVersion, method}); err != nil {
+		return 0, "", err
+	}
+
+	if method == socksMethodPassword {
+		if err := m.authenticate(src); err != nil {
+			return 0, "", err
+		}
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(src, req); err != nil {
+		return 0, "", err
+	} else if req[0] != socksVersion {
+		return 0, "", errSocksVersion
+	}
+
+	addr, err := readSocksAddr(src)
+	if err == errSocksAddress {
+		writeSocksReply(src, socksReplyAddressUnsupported, nil)
+	}
+
+	return req[1], addr, err
+}
+
+// Username/password sub-negotiation checked against the route's passport
+func (m *MapSocks) authenticate(src net.Conn) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(src, hdr); err != nil {
+		return err
+	} else if hdr[0] != socksAuthVersion {
+		return errSocksVersion
+	}
+
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(src, user); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(src, hdr[:1]); err != nil {
+		return err
+	}
+
+	password := make([]byte, hdr[0])
+	if _, err := io.ReadFull(src, password); err != nil {
+		return err
+	}
+
+	name, err := m.passport().Verify(string(user), string(password))
+	if err != nil {
+		src.Write([]byte{socksAuthVersion, 0x01})
+		return err
+	}
+
+	m.Impl.User = name
+
+	_, err = src.Write([]byte{socksAuthVersion, 0x00})
+	return err
+}
+
+func (m *MapSocks) passport() *Passport {
+	if route := m.Impl.Route; route != nil {
+		return route.Passport
+	}
+
+	return nil
+}
+
+func (m *MapSocks) Detour(role Role, buffer []byte) {
+	if role == Client {
+		m.Impl.Mirror.Travel(buffer)
+	}
+	m.Impl.Shortcut.Take(role, buffer)
+}
+
+func (m *MapSocks) GetFlow() Flow {
+	return m.Impl.GetFlow()
+}
+
+func (m *MapSocks) GetImpl() *MapImpl {
+	return &m.Impl
+}
+
+func (m *MapSocks) GetRouteNumber() int {
+	return m.Impl.GetRouteNumber()
+}
+
+// Read an ATYP, DST.ADDR and DST.PORT triple and return it as host:port
+func readSocksAddr(reader io.Reader) (string, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return "", err
+	}
+
+	atyp := b[0]
+	var host []byte
+	switch atyp {
+	case socksAtypIpv4:
+		host = make([]byte, net.IPv4len)
+	case socksAtypIpv6:
+		host = make([]byte, net.IPv6len)
+	case socksAtypDomain:
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return "", err
+		}
+		host = make([]byte, b[0])
+	default:
+		return "", errSocksAddress
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, host); err != nil {
+		return "", err
+	} else if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+
+	name := string(host)
+	if atyp != socksAtypDomain {
+		name = net.IP(host).String()
+	}
+
+	return net.JoinHostPort(name, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socksAddr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socksAtypIpv4}, ip4...)
+	} else {
+		b = append([]byte{socksAtypIpv6}, ip.To16()...)
+	}
+
+	return append(b, byte(port>>8), byte(port))
+}
+
+func writeSocksReply(con net.Conn, reply byte, bound net.Addr) error {
+	_, err := con.Write(append([]byte{socksVersion, reply, 0x00}, socksAddr(bound)...))
+	return err
+}
+
+// Translate a failure to reach a destination into a SOCKS reply code
+func socksReplyCode(err error) byte {
+	if err == errAclDenied {
+		return socksReplyNotAllowed
+	} else if e, ok := err.(socksReplyError); ok {
+		return byte(e)
+	}
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return socksReplyTtlExpired
+	}
+
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+
+	switch e := err.(type) {
+	case *net.DNSError:
+		return socksReplyHostUnreachable
+	case *os.SyscallError:
+		switch e.Err {
+		case syscall.ECONNREFUSED:
+			return socksReplyRefused
+		case syscall.ENETUNREACH:
+			return socksReplyNetUnreachable
+		case syscall.EHOSTUNREACH:
+			return socksReplyHostUnreachable
+		}
+	}
+
+	return socksReplyFailure
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestSocksAddr(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want []byte
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1080}, []byte{socksAtypIpv4, 192, 0, 2, 1, 0x04, 0x38}},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, []byte{socksAtypIpv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}},
+		{&net.UnixAddr{Name: "/tmp/socks"}, []byte{socksAtypIpv4, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, test := range tests {
+		if got := socksAddr(test.addr); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestReadSocksAddr(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want string
+	}{
+		{socksAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1080}), "192.0.2.1:1080"},
+		{socksAddr(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}), "[2001:db8::1]:443"},
+		{append([]byte{socksAtypDomain, 11}, "example.com\x00\x50"...), "example.com:80"},
+	}
+
+	for _, test := range tests {
+		if got, err := readSocksAddr(bytes.NewReader(test.b)); err != nil || got != test.want {
+			t.Errorf("% x: got %q (%v), want %q", test.b, got, err, test.want)
+		}
+	}
+
+	if _, err := readSocksAddr(bytes.NewReader([]byte{0x02, 0, 0})); err != errSocksAddress {
+		t.Errorf("unknown address type: got %v, want %v", err, errSocksAddress)
+	}
+
+	if _, err := readSocksAddr(bytes.NewReader([]byte{socksAtypIpv4, 192, 0})); err == nil {
+		t.Error("truncated address was read")
+	}
+}
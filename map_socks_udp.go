@@ -0,0 +1,154 @@
+package main // SOCKS5 UDP ASSOCIATE relay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+	"github.com/shanebarnes/goto/tokenbucket"
+)
+
+const (
+	socksUdpHeaderLen = 3 // RSV, RSV and FRAG before the address
+	socksUdpMaxSize   = 65535
+)
+
+// Relay datagrams between a client and its destinations until the client's
+// control connection closes
+func (m *MapSocks) associate(src net.Conn, addr string) error {
+	route := m.Impl.Route
+
+	var bindIP net.IP
+	if local, ok := unwrapConn(src).LocalAddr().(*net.TCPAddr); ok {
+		bindIP = local.IP
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		writeSocksReply(src, socksReplyFailure, nil)
+		return err
+	}
+
+	if err = writeSocksReply(src, socksReplySucceeded, relay.LocalAddr()); err != nil {
+		relay.Close()
+		return err
+	}
+
+	m.Impl.Src = src
+	m.Impl.Dst = relay
+
+	traveler := []interface{}{}
+	if len(m.Impl.User) > 0 {
+		traveler = append(traveler, "for user", m.Impl.User)
+	}
+
+	logger.PrintlnInfo(append([]interface{}{"Opening UDP route", m.GetRouteNumber(), ":", src.RemoteAddr().String(), "via", relay.LocalAddr().String(), "flow is", flowText[m.GetFlow()]}, traveler...)...)
+
+	trip := NewTrip(src, relay)
+
+	if m.GetFlow() != Closed {
+		go trip.Watch(time.Duration(route.IdleTimeout)*time.Millisecond, time.Duration(route.Lifetime)*time.Millisecond)
+
+		// The association lasts as long as the control connection
+		go func() {
+			_, err := io.Copy(ioutil.Discard, src)
+			if err == nil {
+				err = io.EOF
+			}
+			trip.End("control connection " + err.Error())
+		}()
+
+		m.relay(src, relay, addr, trip)
+	} else {
+		trip.End("flow is closed")
+	}
+
+	logger.PrintlnInfo(append(append([]interface{}{"Closing UDP route", m.GetRouteNumber(), ":", src.RemoteAddr().String(), "via", relay.LocalAddr().String()}, traveler...), "reason is", trip.Reason())...)
+
+	return nil
+}
+
+func (m *MapSocks) relay(src net.Conn, relay *net.UDPConn, addr string, trip *Trip) {
+	route := m.Impl.Route
+	tag := "UDP-" + strconv.Itoa(m.GetRouteNumber())
+
+	// The client may announce the port it will send from. Otherwise, its
+	// first datagram decides.
+	client := &net.UDPAddr{IP: remoteIP(unwrapConn(src))}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		client.Port, _ = strconv.Atoi(port)
+	}
+
+	var tbs [2]*tokenbucket.TokenBucket
+	changes := int64(-1)
+	destinations := make(map[string]*net.UDPAddr) // Resolved destination addresses
+	peers := make(map[string]bool)                // Destinations that may reply
+	buf := make([]byte, socksUdpHeaderLen+1+255+2+socksUdpMaxSize)
+
+	for {
+		size, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			trip.End(tag + " " + err.Error())
+			break
+		}
+
+		trip.Touch()
+
+		if n := route.live.Changes(); n != changes { // The bandwidth may be adjusted while traveling
+			changes = n
+			tbs[Client] = newBandwidthBucket(route.live.Bandwidth(), socksUdpMaxSize)
+			tbs[Server] = newBandwidthBucket(route.live.Bandwidth(), socksUdpMaxSize)
+		}
+
+		if !peers[from.String()] && from.IP.Equal(client.IP) && (client.Port == 0 || client.Port == from.Port) {
+			client.Port = from.Port
+
+			b := buf[:size]
+			if len(b) <= socksUdpHeaderLen || b[2] != 0 {
+				logger.PrintlnDebug(tag, "dropping malformed or fragmented datagram of", size, "bytes")
+				continue
+			}
+
+			reader := bytes.NewReader(b[socksUdpHeaderLen:])
+			dstAddr, err := readSocksAddr(reader)
+			if err != nil {
+				logger.PrintlnDebug(tag, "dropping datagram:", err.Error())
+				continue
+			}
+
+			dst, ok := destinations[dstAddr]
+			if !ok {
+				if dst, err = resolveDatagram(route, dstAddr); err != nil {
+					logger.PrintlnInfo(tag, "cannot relay datagrams to", dstAddr, ":", err.Error())
+				}
+				destinations[dstAddr] = dst
+			}
+
+			if dst != nil {
+				payload := b[len(b)-reader.Len():]
+				tbs[Client].Remove(uint64(len(payload)))
+				route.stats.Travel(Client, len(payload))
+				logger.PrintlnDebug(tag, "flow is open in this direction: detouring", len(payload), "bytes to", dst.String())
+				relay.WriteToUDP(payload, dst)
+				peers[dst.String()] = true
+			}
+		} else if peers[from.String()] && client.Port != 0 {
+			if m.GetFlow() != TwoWay {
+				logger.PrintlnDebug(tag, "flow is closed in this direction: blocking", size, "bytes")
+				route.stats.Drop(Server, size)
+				continue
+			}
+
+			tbs[Server].Remove(uint64(size))
+			route.stats.Travel(Server, size)
+			logger.PrintlnDebug(tag, "flow is open in this direction: detouring", size, "bytes from", from.String())
+			relay.WriteToUDP(append(append([]byte{0, 0, 0}, socksAddr(from)...), buf[:size]...), client)
+		} else {
+			logger.PrintlnDebug(tag, "dropping datagram of", size, "bytes from stranger", from.String())
+		}
+	}
+}
@@ -12,9 +12,10 @@ type MapTcp struct {
 func (m *MapTcp) FindRoute(guide GuideImpl, src net.Conn) (net.Conn, error) {
 	i := m.Impl.RouteNumber % len(m.Destinations) // Round-robin for now
 
-	dst, err := net.Dial("tcp", m.Destinations[i])
+	dst, dstAddr, err := dialDestination(m.Impl.Route, src, m.Destinations[i])
 	m.Impl.Src = src
 	m.Impl.Dst = dst
+	m.Impl.DstAddr = dstAddr
 
 	return dst, err
 }
@@ -24,7 +25,7 @@ func (m *MapTcp) Detour(role Role, buffer []byte) {
 }
 
 func (m *MapTcp) GetFlow() Flow {
-	return m.Impl.Flow
+	return m.Impl.GetFlow()
 }
 
 func (m *MapTcp) GetImpl() *MapImpl {
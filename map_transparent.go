@@ -0,0 +1,90 @@
+package main // Transparent proxy mode for connections redirected by the firewall
+
+import (
+	"errors"
+	"net"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	transparentRedirect = "redirect" // iptables REDIRECT or DNAT (SO_ORIGINAL_DST)
+	transparentTproxy   = "tproxy"   // iptables TPROXY (IP_TRANSPARENT)
+)
+
+var (
+	errNotRedirected          = errors.New("connection was not redirected to the route")
+	errTransparentMode        = errors.New("unknown transparent proxy mode")
+	errTransparentUnsupported = errors.New("transparent proxy mode is not supported on this platform")
+)
+
+type MapTransparent struct {
+	Impl MapImpl
+}
+
+// Test: iptables -t nat -A OUTPUT -p tcp --dport 80 -m owner ! --uid-owner <detour user> -j REDIRECT --to-ports <port>
+func (m *MapTransparent) FindRoute(guide GuideImpl, src net.Conn) (net.Conn, error) {
+	route := m.Impl.Route
+
+	addr, err := originalDestination(src, route.Transparent)
+	if err != nil {
+		return nil, err
+	} else if isRouteSource(route, addr) {
+		return nil, errNotRedirected
+	}
+
+	logger.PrintlnInfo("Found a transparent route to", addr.String())
+
+	dst, dstAddr, err := dialDestination(route, src, addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	m.Impl.Shortcut = guide.FindShortcut(m.GetRouteNumber(), Client, "", src, dst)
+	m.Impl.Src = src
+	m.Impl.Dst = dst
+	m.Impl.DstAddr = dstAddr
+
+	return dst, nil
+}
+
+func (m *MapTransparent) Detour(role Role, buffer []byte) {
+	if role == Client {
+		m.Impl.Mirror.Travel(buffer)
+	}
+	m.Impl.Shortcut.Take(role, buffer)
+}
+
+func (m *MapTransparent) GetFlow() Flow {
+	return m.Impl.GetFlow()
+}
+
+func (m *MapTransparent) GetImpl() *MapImpl {
+	return &m.Impl
+}
+
+func (m *MapTransparent) GetRouteNumber() int {
+	return m.Impl.GetRouteNumber()
+}
+
+// Connections that arrived without being redirected would otherwise travel
+// the route in a loop
+func isRouteSource(route *Route, addr *net.TCPAddr) bool {
+	src, err := net.ResolveTCPAddr("tcp", route.Src)
+	if err != nil || src.Port != addr.Port {
+		return false
+	} else if !src.IP.IsUnspecified() && src.IP != nil {
+		return src.IP.Equal(addr.IP)
+	} else if addr.IP.IsLoopback() {
+		return true
+	}
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,11 +2,25 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/shanebarnes/goto/logger"
 )
 
+type MetricsSample struct {
+	Time    float64 `json:"time"` // Seconds since the Unix epoch
+	Tag     string  `json:"tag"`
+	Elapsed int64   `json:"elapsed"` // Microseconds since the metrics started
+	Bytes   int64   `json:"bytes"`   // Bytes since the previous sample
+	Total   int64   `json:"total"`   // Bytes since the metrics started
+	Mbps    float64 `json:"mbps"`    // Average megabits per second since the metrics started
+	Final   bool    `json:"final,omitempty"`
+}
+
+func (s MetricsSample) String() string {
+	return fmt.Sprintf("%.6f,%s,%d,%d,%d,%.6f", s.Time, s.Tag, s.Elapsed, s.Bytes, s.Total, s.Mbps)
+}
+
 type Metrics struct {
 	timeStartNs   int64
 	timeReportNs  int64 // Last report time
@@ -15,7 +29,76 @@ type Metrics struct {
 	reportIntByte int64
 	byteCount     int64
 	tag           string
-	buffer        []string
+	reporter      *Reporter
+}
+
+// Current and peak number of concurrent connections
+type Gauge struct {
+	current int64
+	peak    int64
+}
+
+func (g *Gauge) Inc() int64 {
+	n := atomic.AddInt64(&g.current, 1)
+
+	for peak := atomic.LoadInt64(&g.peak); n > peak; peak = atomic.LoadInt64(&g.peak) {
+		if atomic.CompareAndSwapInt64(&g.peak, peak, n) {
+			break
+		}
+	}
+
+	return n
+}
+
+func (g *Gauge) Dec() int64 {
+	return atomic.AddInt64(&g.current, -1)
+}
+
+func (g *Gauge) Current() int64 {
+	return atomic.LoadInt64(&g.current)
+}
+
+func (g *Gauge) Peak() int64 {
+	return atomic.LoadInt64(&g.peak)
+}
+
+// Cumulative distribution of observed values (e.g., seconds)
+type Histogram struct {
+	mutex  sync.Mutex
+	bounds []float64 // Upper bounds of each bucket in ascending order
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	histogram := new(Histogram)
+	histogram.bounds = bounds
+	histogram.counts = make([]uint64, len(bounds))
+	return histogram
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i := range h.bounds {
+		if value <= h.bounds[i] {
+			h.counts[i] = h.counts[i] + 1
+		}
+	}
+
+	h.count = h.count + 1
+	h.sum = h.sum + value
+}
+
+// Return the bucket bounds, the cumulative count of each bucket, the total
+// count and the sum of all observations
+func (h *Histogram) Snapshot() ([]float64, []uint64, uint64, float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.bounds, append([]uint64(nil), h.counts...), h.count, h.sum
 }
 
 func MetricsNew(reportIntNs int64, reportIntByte int64, tag string) *Metrics {
@@ -37,21 +120,41 @@ func (m *Metrics) Add(bytes int64) {
 	m.byteReport = m.byteReport + bytes
 
 	if (m.reportIntNs > 0 && now >= m.timeReportNs) || (m.reportIntByte > 0 && m.byteReport >= m.reportIntByte) {
-		avgBps := float64(m.byteCount) * 8. * 1000000000. / float64(now-m.timeStartNs)
-		m.buffer = append(m.buffer, fmt.Sprintf("%.6f,%s,%d,%d,%d,%.6f", float64(now)/1000000000., m.tag, (now-m.timeStartNs)/1000, bytes, m.byteCount, avgBps/1000000.))
+		m.reporter.Report(m.sample(now))
 
-		m.byteReport = 0
-		for m.timeReportNs <= now {
+		for m.reportIntNs > 0 && m.timeReportNs <= now {
 			m.timeReportNs = m.timeReportNs + m.reportIntNs
 		}
 	}
 }
 
-func (m *Metrics) Dump() {
-	m.timeReportNs = time.Now().UnixNano()
-	m.Add(0)
+// Add bytes and take a sample regardless of the report interval
+func (m *Metrics) Sample(bytes int64) {
+	m.byteCount = m.byteCount + bytes
+	m.byteReport = m.byteReport + bytes
+	m.reporter.Report(m.sample(time.Now().UnixNano()))
+}
 
-	for _, record := range m.buffer {
-		logger.PrintlnInfo(record)
+func (m *Metrics) sample(now int64) MetricsSample {
+	avgBps := 0.
+	if now > m.timeStartNs {
+		avgBps = float64(m.byteCount) * 8. * 1000000000. / float64(now-m.timeStartNs)
 	}
+
+	sample := MetricsSample{Time: float64(now) / 1000000000., Tag: m.tag, Elapsed: (now - m.timeStartNs) / 1000, Bytes: m.byteReport, Total: m.byteCount, Mbps: avgBps / 1000000.}
+	m.byteReport = 0
+
+	return sample
+}
+
+// Report and return a final sample covering everything since the metrics
+// started
+func (m *Metrics) Summary() MetricsSample {
+	sample := m.sample(time.Now().UnixNano())
+	sample.Bytes = sample.Total
+	sample.Final = true
+
+	m.reporter.Report(sample)
+
+	return sample
 }
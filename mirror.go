@@ -0,0 +1,144 @@
+package main // Copies of client bytes sent to a shadow backend
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	mirrorQueueLen = 1024             // Buffers waiting for the shadow backend before mirroring gives up
+	mirrorLinger   = 30 * time.Second // Max time the shadow backend may take to respond once the client is done
+)
+
+var errMirrorBehind = errors.New("shadow backend fell too far behind")
+
+// The shadow backend is dialed and written to apart from the trip so that
+// it can never slow down or close the primary connection
+type Mirror struct {
+	Dst    string  `json:"dst"`    // Shadow backend
+	Sample float64 `json:"sample"` // Percentage of connections mirrored (0 = 100)
+	count  int64   // Connections considered for mirroring
+}
+
+type MirrorStream struct {
+	mirror *Mirror
+	route  *Route
+	queue  chan []byte
+	failed int32 // Non-zero once mirroring has given up
+	once   sync.Once
+}
+
+// Return true for the sampled percentage of calls, spread evenly
+func (m *Mirror) sampled() bool {
+	if m.Sample <= 0 || m.Sample >= 100 {
+		return true
+	}
+
+	n := float64(atomic.AddInt64(&m.count, 1))
+	return math.Floor(n*m.Sample/100) > math.Floor((n-1)*m.Sample/100)
+}
+
+// Start mirroring a trip unless it is not sampled. Returns nil if the trip is
+// not mirrored.
+func (m *Mirror) Open(route *Route, src net.Conn) *MirrorStream {
+	if m == nil || len(m.Dst) == 0 || !m.sampled() {
+		return nil
+	}
+
+	stream := new(MirrorStream)
+	stream.mirror = m
+	stream.route = route
+	stream.queue = make(chan []byte, mirrorQueueLen)
+
+	go stream.run(src)
+
+	return stream
+}
+
+func (s *MirrorStream) run(src net.Conn) {
+	// Clients that never have bytes forwarded (e.g., no route is found) are
+	// not mirrored at all
+	first, ok := <-s.queue
+	if !ok {
+		return
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(s.route.ConnectTimeout) * time.Millisecond}
+	shadow, err := dialer.Dial("tcp", s.mirror.Dst)
+	if err == nil && len(s.route.ProxyOut) > 0 {
+		if err = writeProxyHeader(shadow, s.route.ProxyOut, src.RemoteAddr(), src.LocalAddr()); err != nil {
+			shadow.Close()
+		}
+	}
+
+	if err != nil {
+		s.fail(err)
+		for range s.queue {
+		}
+		return
+	}
+	defer shadow.Close()
+
+	logger.PrintlnDebug("Mirroring", src.RemoteAddr().String(), "to", s.mirror.Dst)
+
+	discarded := make(chan struct{})
+	go func() { // Responses of the shadow backend are never returned
+		io.Copy(ioutil.Discard, shadow)
+		close(discarded)
+	}()
+
+	for buffer := first; ok; buffer, ok = <-s.queue {
+		if atomic.LoadInt32(&s.failed) != 0 {
+			shadow.Close() // The shadow backend would only see part of the stream
+			continue
+		}
+
+		shadow.SetWriteDeadline(time.Now().Add(mirrorLinger))
+		if _, err := shadow.Write(buffer); err != nil {
+			s.fail(err)
+		}
+	}
+
+	if atomic.LoadInt32(&s.failed) != 0 {
+		return
+	}
+
+	closeWrite(shadow)
+	shadow.SetDeadline(time.Now().Add(mirrorLinger))
+	<-discarded
+}
+
+func (s *MirrorStream) fail(err error) {
+	if atomic.CompareAndSwapInt32(&s.failed, 0, 1) {
+		logger.PrintlnInfo("Stopped mirroring to", s.mirror.Dst, ":", err.Error())
+	}
+}
+
+// Send a copy of client bytes forwarded to the destination unless the shadow
+// backend has failed or fallen too far behind
+func (s *MirrorStream) Travel(buffer []byte) {
+	if s == nil || len(buffer) == 0 || atomic.LoadInt32(&s.failed) != 0 {
+		return
+	}
+
+	select {
+	case s.queue <- append([]byte(nil), buffer...):
+	default:
+		s.fail(errMirrorBehind)
+	}
+}
+
+// Stop mirroring once the client is done sending
+func (s *MirrorStream) Finish() {
+	if s != nil {
+		s.once.Do(func() { close(s.queue) })
+	}
+}
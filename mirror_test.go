@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// The shadow backend is sent the rewritten bytes that the destination is
+// sent, never the credentials or fields stripped from them
+func TestMirrorForwardedBytes(t *testing.T) {
+	server := new(bufferConn)
+	client, _ := net.ResolveTCPAddr("tcp", "192.0.2.1:51000")
+
+	m := new(MapHttp)
+	m.Impl.Route = &Route{
+		Forwarded: true,
+		Passport:  &Passport{Users: map[string]string{"user": "secret"}},
+		Rewrite:   []RewriteRule{{Request: &HeaderEdit{Remove: []string{"Authorization"}}}},
+	}
+	m.Impl.Src, m.Impl.Dst = &replayConn{remote: client}, server
+	m.Impl.Shortcut = new(ShortcutNull)
+	m.Impl.Shortcut.New(0, m.Impl.Src, server, 0, false)
+	m.Impl.Mirror = &MirrorStream{queue: make(chan []byte, mirrorQueueLen)}
+	m.inspect()
+
+	request := "POST /a HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: Basic dXNlcjpzZWNyZXQ=\r\nAuthorization: Bearer token\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET /b HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: Basic dXNlcjpzZWNyZXQ=\r\n\r\n"
+	for i := 0; i < len(request); i = i + 16 {
+		end := i + 16
+		if end > len(request) {
+			end = len(request)
+		}
+		m.detour(Client, []byte(request[i:end]))
+	}
+
+	m.Impl.Mirror.Finish()
+	var mirrored []byte
+	for buffer := range m.Impl.Mirror.queue {
+		mirrored = append(mirrored, buffer...)
+	}
+
+	if !bytes.Equal(mirrored, server.written.Bytes()) {
+		t.Errorf("mirrored %q, destination was sent %q", mirrored, server.written.Bytes())
+	}
+
+	for _, field := range []string{"Proxy-Authorization", "Authorization:", "dXNlcjpzZWNyZXQ=", "Bearer"} {
+		if strings.Contains(string(mirrored), field) {
+			t.Errorf("%q was mirrored: %q", field, mirrored)
+		}
+	}
+
+	if strings.Count(string(mirrored), "X-Forwarded-For: 192.0.2.1\r\n") != 2 || !strings.Contains(string(mirrored), "\r\n\r\nbody") {
+		t.Errorf("forwarded fields or body missing from %q", mirrored)
+	}
+}
+
+func TestMirrorSampled(t *testing.T) {
+	tests := []struct {
+		sample float64
+		want   int
+	}{
+		{0, 100},
+		{100, 100},
+		{50, 50},
+		{25, 25},
+		{1, 1},
+	}
+
+	for _, test := range tests {
+		mirror := &Mirror{Sample: test.sample}
+
+		got := 0
+		for i := 0; i < 100; i++ {
+			if mirror.sampled() {
+				got++
+			}
+		}
+
+		if got != test.want {
+			t.Errorf("sample %v%%: got %d of 100, want %d", test.sample, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main // Credentials needed to travel a route
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	apr1Magic    = "$apr1$"
+	basicScheme  = "Basic "
+	defaultRealm = "detour"
+	desCryptLen  = 13
+	itoa64       = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	shaPrefix    = "{SHA}"
+)
+
+var errProxyAuth = errors.New("proxy authentication required")
+
+type Passport struct {
+	Htpasswd string            `json:"htpasswd"` // File containing htpasswd-style user:hash entries ({SHA}, $apr1$ or plain text)
+	Realm    string            `json:"realm"`    // Realm presented to clients that fail to authenticate
+	Users    map[string]string `json:"users"`    // Additional user:hash entries
+	entries  map[string]string
+}
+
+func (p *Passport) Load() error {
+	var err error
+
+	p.entries = make(map[string]string)
+	for user, hash := range p.Users {
+		p.entries[user] = hash
+	}
+
+	if len(p.Htpasswd) > 0 {
+		var file *os.File
+		if file, err = os.Open(p.Htpasswd); err == nil {
+			defer file.Close()
+
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if len(line) == 0 || strings.HasPrefix(line, "#") {
+					continue
+				}
+
+				if i := strings.Index(line, ":"); i > 0 {
+					p.entries[line[:i]] = line[i+1:]
+				}
+			}
+			err = scanner.Err()
+		}
+	}
+
+	// Such a hash would otherwise be compared as a plain-text password, letting
+	// anyone who knows it in
+	for user, hash := range p.entries {
+		if unsupportedHash(hash) {
+			logger.PrintlnError("Unsupported password hash for user", user, ": user is refused")
+			delete(p.entries, user)
+		}
+	}
+
+	if len(p.Realm) == 0 {
+		p.Realm = defaultRealm
+	}
+
+	logger.PrintlnInfo("Loaded", len(p.entries), "passport entries for realm", p.Realm)
+
+	return err
+}
+
+// Return the authenticated user name of a Proxy-Authorization header value
+func (p *Passport) Check(authorization string) (string, error) {
+	if len(authorization) > len(basicScheme) && strings.EqualFold(authorization[:len(basicScheme)], basicScheme) {
+		if cred, err := base64.StdEncoding.DecodeString(strings.TrimSpace(authorization[len(basicScheme):])); err == nil {
+			if i := strings.Index(string(cred), ":"); i >= 0 {
+				return p.Verify(string(cred[:i]), string(cred[i+1:]))
+			}
+		}
+	}
+
+	return "", errProxyAuth
+}
+
+func (p *Passport) Verify(user, password string) (string, error) {
+	var computed string
+
+	hash, ok := p.entries[user]
+	switch {
+	case !ok:
+		return "", errProxyAuth
+	case strings.HasPrefix(hash, shaPrefix):
+		sum := sha1.Sum([]byte(password))
+		computed = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := strings.TrimPrefix(hash, apr1Magic)
+		if i := strings.Index(salt, "$"); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1Crypt([]byte(password), []byte(salt))
+	default:
+		computed = password
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(computed)) != 1 {
+		return "", errProxyAuth
+	}
+
+	return user, nil
+}
+
+// Check if an entry is a hash other than {SHA} or $apr1$, e.g. bcrypt ($2y$),
+// SHA-crypt ($5$, $6$) or crypt(3) DES, rather than a plain-text password
+func unsupportedHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, shaPrefix), strings.HasPrefix(hash, apr1Magic):
+		return false
+	case strings.HasPrefix(hash, "$"):
+		return true
+	}
+
+	return len(hash) == desCryptLen && len(strings.Trim(hash, itoa64)) == 0
+}
+
+func (p *Passport) Challenge() string {
+	return basicScheme + "realm=\"" + p.Realm + "\""
+}
+
+// Apache MD5-crypt password hash
+func apr1Crypt(password, salt []byte) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	d := md5.New()
+	d.Write(password)
+	d.Write([]byte(apr1Magic))
+	d.Write(salt)
+
+	alt := md5.New()
+	alt.Write(password)
+	alt.Write(salt)
+	alt.Write(password)
+	mixin := alt.Sum(nil)
+
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(mixin)
+		} else {
+			d.Write(mixin[:i])
+		}
+	}
+
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(password[:1])
+		}
+	}
+
+	final := d.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(password)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write(salt)
+		}
+		if i%7 != 0 {
+			round.Write(password)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(password)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out []byte
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	to64(uint(final[0])<<16|uint(final[6])<<8|uint(final[12]), 4)
+	to64(uint(final[1])<<16|uint(final[7])<<8|uint(final[13]), 4)
+	to64(uint(final[2])<<16|uint(final[8])<<8|uint(final[14]), 4)
+	to64(uint(final[3])<<16|uint(final[9])<<8|uint(final[15]), 4)
+	to64(uint(final[4])<<16|uint(final[10])<<8|uint(final[5]), 4)
+	to64(uint(final[11]), 2)
+
+	return apr1Magic + string(salt) + "$" + string(out)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// Known answers from openssl passwd -apr1 -salt <salt> <password>
+func TestApr1Crypt(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		{"password", "r31....", "$apr1$r31....$kMmt8Ia8qcWk4vKKEhpgx1"},
+		{"detour:pass!", "abcdefgh", "$apr1$abcdefgh$pvtfl0vXVgejQlQuNfB9d."},
+		{"x", "s", "$apr1$s$bHQMM1UunWFj8XWEuTGlW."},
+		{"x", "longersaltvalue", "$apr1$longersa$ve1pOxLT/53tB8sxc.hAK."},
+	}
+
+	for _, test := range tests {
+		if got := apr1Crypt([]byte(test.password), []byte(test.salt)); got != test.want {
+			t.Errorf("%q with salt %q: got %s, want %s", test.password, test.salt, got, test.want)
+		}
+	}
+}
+
+func TestPassportCheck(t *testing.T) {
+	passport := &Passport{Users: map[string]string{
+		"apr1":   "$apr1$r31....$kMmt8Ia8qcWk4vKKEhpgx1",
+		"sha":    "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"plain":  "secret",
+		"bcrypt": "$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC",
+		"des":    "rqXexS6ZhobKA",
+	}}
+	passport.Load()
+
+	tests := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"apr1", "password", true},
+		{"apr1", "Password", false},
+		{"sha", "secret", true},
+		{"sha", "secret ", false},
+		{"plain", "secret", true},
+		{"bcrypt", "$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC", false},
+		{"des", "rqXexS6ZhobKA", false},
+		{"nobody", "secret", false},
+	}
+
+	for _, test := range tests {
+		authorization := basicScheme + base64.StdEncoding.EncodeToString([]byte(test.user+":"+test.password))
+		user, err := passport.Check(authorization)
+		if ok := err == nil && user == test.user; ok != test.ok {
+			t.Errorf("%s:%s: got %q (%v)", test.user, test.password, user, err)
+		}
+	}
+
+	if _, err := passport.Check("Bearer token"); err != errProxyAuth {
+		t.Errorf("got %v, want %v", err, errProxyAuth)
+	}
+}
@@ -0,0 +1,150 @@
+package main // Prometheus text exposition of route stats
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+var roleText = map[Role]string{
+	Client: "client",
+	Server: "server",
+}
+
+var textRole = map[string]Role{
+	"client": Client,
+	"server": Server,
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Test: curl http://<metrics address>/metrics
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(writeMetrics())
+	})
+
+	logger.PrintlnInfo("Serving metrics on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.PrintlnError(err.Error())
+	}
+}
+
+func writeMetrics() []byte {
+	var buf bytes.Buffer
+	routes := AllRouteStats()
+
+	writeFamily(&buf, "detour_connections", "gauge", "Connections traveling all routes.")
+	writeSample(&buf, "detour_connections", "", _capacity.Connections.Current())
+	writeFamily(&buf, "detour_connections_peak", "gauge", "Most connections that have traveled all routes at the same time.")
+	writeSample(&buf, "detour_connections_peak", "", _capacity.Connections.Peak())
+
+	counters := []struct {
+		name, help string
+		value      func(s *RouteStats) int64
+	}{
+		{"detour_route_connections_accepted_total", "Connections accepted by a route.", func(s *RouteStats) int64 { return atomic.LoadInt64(&s.Accepted) }},
+		{"detour_route_connections_refused_total", "Connections turned away by a route's checkpoint or capacity.", func(s *RouteStats) int64 { return atomic.LoadInt64(&s.Refused) }},
+		{"detour_route_connections_failed_total", "Connections for which no destination could be found or reached.", func(s *RouteStats) int64 { return atomic.LoadInt64(&s.Failed) }},
+		{"detour_route_shortcuts_total", "Connections that took a shortcut.", func(s *RouteStats) int64 { return atomic.LoadInt64(&s.Shortcuts) }},
+	}
+
+	for _, c := range counters {
+		writeFamily(&buf, c.name, "counter", c.help)
+		for _, s := range routes {
+			writeSample(&buf, c.name, routeLabels(s), c.value(s))
+		}
+	}
+
+	writeFamily(&buf, "detour_route_connections", "gauge", "Connections traveling a route.")
+	for _, s := range routes {
+		writeSample(&buf, "detour_route_connections", routeLabels(s), s.Capacity.Connections.Current())
+	}
+
+	writeFamily(&buf, "detour_route_connections_peak", "gauge", "Most connections that have traveled a route at the same time.")
+	for _, s := range routes {
+		writeSample(&buf, "detour_route_connections_peak", routeLabels(s), s.Capacity.Connections.Peak())
+	}
+
+	writeFamily(&buf, "detour_route_bytes_total", "counter", "Bytes read from each side of a route.")
+	for _, s := range routes {
+		for _, role := range []Role{Client, Server} {
+			writeSample(&buf, "detour_route_bytes_total", routeLabels(s, "side", roleText[role]), atomic.LoadInt64(&s.Bytes[role]))
+		}
+	}
+
+	writeFamily(&buf, "detour_route_dropped_bytes_total", "counter", "Bytes read from each side of a route and blocked by flow control.")
+	for _, s := range routes {
+		for _, role := range []Role{Client, Server} {
+			writeSample(&buf, "detour_route_dropped_bytes_total", routeLabels(s, "side", roleText[role]), atomic.LoadInt64(&s.Dropped[role]))
+		}
+	}
+
+	writeFamily(&buf, "detour_route_dial_errors_total", "counter", "Failed attempts to reach a destination.")
+	for _, s := range routes {
+		destinations := s.Destinations()
+		addrs := make([]string, 0, len(destinations))
+		for addr := range destinations {
+			if destinations[addr].Errors > 0 {
+				addrs = append(addrs, addr)
+			}
+		}
+		sort.Strings(addrs)
+
+		for _, addr := range addrs {
+			writeSample(&buf, "detour_route_dial_errors_total", routeLabels(s, "destination", addr), destinations[addr].Errors)
+		}
+	}
+
+	writeFamily(&buf, "detour_route_duration_seconds", "histogram", "Time connections traveled a route.")
+	for _, s := range routes {
+		writeHistogram(&buf, "detour_route_duration_seconds", routeLabels(s), s.Duration)
+	}
+
+	writeFamily(&buf, "detour_route_dial_seconds", "histogram", "Time taken to reach a destination.")
+	for _, s := range routes {
+		writeHistogram(&buf, "detour_route_dial_seconds", routeLabels(s), s.DialLatency)
+	}
+
+	return buf.Bytes()
+}
+
+func writeFamily(buf *bytes.Buffer, name, kind, help string) {
+	buf.WriteString("# HELP " + name + " " + help + "\n")
+	buf.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func writeSample(buf *bytes.Buffer, name, labels string, value int64) {
+	buf.WriteString(name + labels + " " + strconv.FormatInt(value, 10) + "\n")
+}
+
+func writeHistogram(buf *bytes.Buffer, name, labels string, histogram *Histogram) {
+	bounds, counts, count, sum := histogram.Snapshot()
+	prefix := strings.TrimSuffix(labels, "}") + ","
+
+	for i := range bounds {
+		le := strconv.FormatFloat(bounds[i], 'g', -1, 64)
+		buf.WriteString(name + "_bucket" + prefix + "le=\"" + le + "\"} " + strconv.FormatUint(counts[i], 10) + "\n")
+	}
+
+	buf.WriteString(name + "_bucket" + prefix + "le=\"+Inf\"} " + strconv.FormatUint(count, 10) + "\n")
+	buf.WriteString(name + "_sum" + labels + " " + strconv.FormatFloat(sum, 'g', -1, 64) + "\n")
+	buf.WriteString(name + "_count" + labels + " " + strconv.FormatUint(count, 10) + "\n")
+}
+
+// Format the route label followed by any extra name and value pairs
+func routeLabels(s *RouteStats, pairs ...string) string {
+	labels := []string{"route=\"" + labelEscaper.Replace(s.Name) + "\""}
+	for i := 0; i+1 < len(pairs); i = i + 2 {
+		labels = append(labels, pairs[i]+"=\""+labelEscaper.Replace(pairs[i+1])+"\"")
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
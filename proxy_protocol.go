@@ -0,0 +1,234 @@
+package main // HAProxy PROXY protocol (https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt)
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	proxyV1           = "v1"
+	proxyV1Prefix     = "PROXY "
+	proxyV1MaxLen     = 107
+	proxyV2           = "v2"
+	proxyV2HeaderLen  = 16
+	proxyV2Signature  = "\r\n\r\n\x00\r\nQUIT\n"
+	proxyV2CmdLocal   = 0x20
+	proxyV2CmdProxy   = 0x21
+	proxyV2FamilyTcp4 = 0x11
+	proxyV2FamilyTcp6 = 0x21
+)
+
+var (
+	errProxyFrom   = errors.New("proxyFrom must list the load balancers trusted to send PROXY protocol headers")
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// A connection whose addresses were announced by a PROXY protocol header
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *proxiedConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Check if a peer is a load balancer trusted to announce the address of the
+// client it connected on behalf of
+func trustsProxy(rules []aclRule, con net.Conn) bool {
+	ip := remoteIP(con)
+	for i := range rules {
+		if rules[i].matches("", ip, remotePort(con)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Read a v1 or v2 PROXY protocol header and return a connection that reports
+// the original client and destination addresses
+func readProxyHeader(con net.Conn, wait time.Duration) (net.Conn, error) {
+	con.SetReadDeadline(time.Now().Add(wait))
+	defer con.SetReadDeadline(time.Time{})
+
+	// Both versions are at least as long as the v2 signature
+	head := make([]byte, len(proxyV2Signature), proxyV1MaxLen)
+	if _, err := io.ReadFull(con, head); err != nil {
+		return con, err
+	}
+
+	var remote, local net.Addr
+	var err error
+
+	if string(head) == proxyV2Signature {
+		remote, local, err = readProxyV2(con)
+	} else if strings.HasPrefix(string(head), proxyV1Prefix) {
+		b := make([]byte, 1)
+		for !bytes.HasSuffix(head, []byte("\r\n")) && err == nil {
+			if len(head) >= proxyV1MaxLen {
+				err = errProxyHeader
+			} else if _, err = io.ReadFull(con, b); err == nil {
+				head = append(head, b[0])
+			}
+		}
+
+		if err == nil {
+			remote, local, err = parseProxyV1(string(head[:len(head)-2]))
+		}
+	} else {
+		err = errProxyHeader
+	}
+
+	if err != nil {
+		return con, err
+	}
+
+	if remote == nil || local == nil { // Health checks from the load balancer itself
+		return con, nil
+	}
+
+	logger.PrintlnDebug("Connection from", con.RemoteAddr().String(), "is proxied for", remote.String())
+
+	return &proxiedConn{Conn: con, remote: remote, local: local}, nil
+}
+
+func parseProxyV1(line string) (net.Addr, net.Addr, error) {
+	fields := strings.Fields(line)
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	} else if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+
+	remote, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	local, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return remote, local, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	portNum, err := strconv.Atoi(port)
+
+	if ip == nil || err != nil || portNum < 0 || portNum > 65535 {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: portNum}, nil
+}
+
+func readProxyV2(con net.Conn) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, proxyV2HeaderLen-len(proxyV2Signature))
+	if _, err := io.ReadFull(con, hdr); err != nil {
+		return nil, nil, err
+	}
+
+	cmd, family := hdr[0], hdr[1]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(con, body); err != nil {
+		return nil, nil, err
+	}
+
+	if cmd == proxyV2CmdLocal {
+		return nil, nil, nil
+	} else if cmd != proxyV2CmdProxy {
+		return nil, nil, errProxyHeader
+	}
+
+	ipLen := 0
+	switch family {
+	case proxyV2FamilyTcp4:
+		ipLen = net.IPv4len
+	case proxyV2FamilyTcp6:
+		ipLen = net.IPv6len
+	default: // Unsupported families are treated like LOCAL connections
+		return nil, nil, nil
+	}
+
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errProxyHeader
+	}
+
+	remote := &net.TCPAddr{IP: net.IP(body[:ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen:]))}
+	local := &net.TCPAddr{IP: net.IP(body[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:]))}
+
+	return remote, local, nil
+}
+
+// Announce the original client and destination addresses of a route
+func writeProxyHeader(con net.Conn, version string, remote net.Addr, local net.Addr) error {
+	var header []byte
+
+	src, srcOk := remote.(*net.TCPAddr)
+	dst, dstOk := local.(*net.TCPAddr)
+	tcp4 := srcOk && dstOk && src.IP.To4() != nil && dst.IP.To4() != nil
+
+	switch version {
+	case proxyV1:
+		if !srcOk || !dstOk || (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+			header = []byte("PROXY UNKNOWN\r\n")
+		} else {
+			family := "TCP6"
+			if tcp4 {
+				family = "TCP4"
+			}
+			header = []byte(strings.Join([]string{"PROXY", family, src.IP.String(), dst.IP.String(), strconv.Itoa(src.Port), strconv.Itoa(dst.Port)}, " ") + "\r\n")
+		}
+	case proxyV2:
+		header = []byte(proxyV2Signature)
+
+		if !srcOk || !dstOk {
+			header = append(header, proxyV2CmdLocal, 0, 0, 0)
+		} else {
+			var addrs []byte
+			family := byte(proxyV2FamilyTcp6)
+			if tcp4 {
+				family = proxyV2FamilyTcp4
+				addrs = append(append(addrs, src.IP.To4()...), dst.IP.To4()...)
+			} else {
+				addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+			}
+
+			ports := make([]byte, 4)
+			binary.BigEndian.PutUint16(ports, uint16(src.Port))
+			binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+			addrs = append(addrs, ports...)
+
+			length := make([]byte, 2)
+			binary.BigEndian.PutUint16(length, uint16(len(addrs)))
+			header = append(append(append(header, proxyV2CmdProxy, family), length...), addrs...)
+		}
+	default:
+		return errors.New("unsupported PROXY protocol version '" + version + "'")
+	}
+
+	_, err := con.Write(header)
+
+	return err
+}
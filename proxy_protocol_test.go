@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		version string
+		remote  string
+		local   string
+	}{
+		{proxyV1, "192.0.2.1:51000", "198.51.100.2:443"},
+		{proxyV1, "[2001:db8::1]:51000", "[2001:db8::2]:443"},
+		{proxyV2, "192.0.2.1:51000", "198.51.100.2:443"},
+		{proxyV2, "[2001:db8::1]:51000", "[2001:db8::2]:443"},
+	}
+
+	for _, test := range tests {
+		remote, _ := net.ResolveTCPAddr("tcp", test.remote)
+		local, _ := net.ResolveTCPAddr("tcp", test.local)
+
+		client, server := net.Pipe()
+		go func(version string) {
+			writeProxyHeader(client, version, remote, local)
+			client.Write([]byte("payload"))
+			client.Close()
+		}(test.version)
+
+		con, err := readProxyHeader(server, time.Second)
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.version, test.remote, err)
+		}
+
+		if con.RemoteAddr().String() != remote.String() || con.LocalAddr().String() != local.String() {
+			t.Errorf("%s: got %s -> %s, want %s -> %s", test.version, con.RemoteAddr(), con.LocalAddr(), remote, local)
+		}
+
+		if payload, _ := ioutil.ReadAll(con); string(payload) != "payload" {
+			t.Errorf("%s: bytes after the header were %q", test.version, payload)
+		}
+	}
+}
+
+func TestProxyHeaderUnknown(t *testing.T) {
+	for _, version := range []string{proxyV1, proxyV2} {
+		client, server := net.Pipe()
+		go func(version string) {
+			writeProxyHeader(client, version, &net.UnixAddr{Name: "/tmp/a"}, &net.UnixAddr{Name: "/tmp/b"})
+			client.Close()
+		}(version)
+
+		con, err := readProxyHeader(server, time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+
+		if _, ok := con.(*proxiedConn); ok {
+			t.Errorf("%s: connection without addresses was proxied for %s", version, con.RemoteAddr())
+		}
+	}
+}
+
+func TestParseProxyV1(t *testing.T) {
+	bad := []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.2 51000",
+		"PROXY UDP4 192.0.2.1 198.51.100.2 51000 443",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 51000 65536",
+		"PROXY TCP4 host 198.51.100.2 51000 443",
+	}
+
+	for _, line := range bad {
+		if _, _, err := parseProxyV1(line); err != errProxyHeader {
+			t.Errorf("%q: got %v, want %v", line, err, errProxyHeader)
+		}
+	}
+}
+
+func TestTrustsProxy(t *testing.T) {
+	rules, err := parseAclRules([]string{"10.0.0.0/8", "[2001:db8::1]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		peer string
+		want bool
+	}{
+		{"10.1.2.3:40000", true},
+		{"[2001:db8::1]:40000", true},
+		{"192.0.2.1:40000", false},
+		{"[2001:db8::2]:40000", false},
+	}
+
+	for _, test := range tests {
+		addr, _ := net.ResolveTCPAddr("tcp", test.peer)
+		if got := trustsProxy(rules, &replayConn{remote: addr}); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.peer, got, test.want)
+		}
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "10.1.2.3:40000")
+	if trustsProxy(nil, &replayConn{remote: addr}) {
+		t.Error("peer was trusted without any trusted load balancers")
+	}
+}
@@ -0,0 +1,396 @@
+package main // Record sessions traveling a route and replay either side of them later
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"hash"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	recordingMock   = "mock"   // Serve the recorded server side to clients instead of dialing a destination
+	recordingRecord = "record" // Record every session traveling the route
+	recordingReplay = "replay" // Replay the recorded client side against the route's destinations
+
+	recordClose = "close"
+	recordData  = "data"
+	recordOpen  = "open"
+
+	defaultRecordingWait = 10000 // Milliseconds
+)
+
+var (
+	errRecordingEmpty = errors.New("recording has no sessions")
+	errRecordingFile  = errors.New("recording file is required")
+	errRecordingMode  = errors.New("recording mode must be \"record\", \"replay\" or \"mock\"")
+)
+
+type Recording struct {
+	Mode     string  `json:"mode"`  // "record", "replay" (client side against the destinations) or "mock" (server side to clients)
+	File     string  `json:"file"`  // JSON lines file of recorded events
+	Speed    float64 `json:"speed"` // Replay speed (0 or 1 = recorded timing, 2 = twice as fast, -1 = no waiting)
+	Wait     int64   `json:"wait"`  // Milliseconds a replay waits for the other side to send what it sent when recorded (0 = 10000)
+	mutex    sync.Mutex
+	file     *os.File
+	sessions []*recordedSession
+	next     int64 // Next session served in mock mode
+}
+
+// One line of a recording
+type RecordEvent struct {
+	Session int64  `json:"session"`
+	Time    int64  `json:"time"`  // Microseconds since the Unix epoch
+	Event   string `json:"event"` // "open", "data" or "close"
+	Role    string `json:"role,omitempty"`
+	Client  string `json:"client,omitempty"` // Client address when opened
+	Server  string `json:"server,omitempty"` // Server address when opened
+	Data    []byte `json:"data,omitempty"`
+}
+
+type recordedSession struct {
+	open   RecordEvent
+	events []RecordEvent
+	bytes  [2]int64  // Bytes sent by each side
+	sums   [2][]byte // SHA-256 of the bytes sent by each side
+}
+
+// Records the sessions of a trip
+type RecordingSession struct {
+	recording *Recording
+	id        int64
+}
+
+func (r *Recording) Load() error {
+	if len(r.File) == 0 {
+		return errRecordingFile
+	}
+
+	if r.Wait <= 0 {
+		r.Wait = defaultRecordingWait
+	}
+
+	switch r.Mode {
+	case recordingRecord:
+		file, err := os.OpenFile(r.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			r.file = file
+		}
+		return err
+	case recordingMock, recordingReplay:
+		return r.read()
+	}
+
+	return errRecordingMode
+}
+
+func (r *Recording) read() error {
+	file, err := os.Open(r.File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sessions := make(map[int64]*recordedSession)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var event RecordEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return err
+		}
+
+		session, ok := sessions[event.Session]
+		if event.Event == recordOpen {
+			session = &recordedSession{open: event}
+			sessions[event.Session] = session
+			r.sessions = append(r.sessions, session)
+			continue
+		} else if !ok {
+			continue // Opened before the recording was truncated
+		}
+
+		session.events = append(session.events, event)
+		if role, ok := textRole[event.Role]; ok && event.Event == recordData {
+			session.bytes[role] = session.bytes[role] + int64(len(event.Data))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	} else if len(r.sessions) == 0 {
+		return errRecordingEmpty
+	}
+
+	for _, session := range r.sessions {
+		sums := [2]hash.Hash{sha256.New(), sha256.New()}
+		for _, event := range session.events {
+			if role, ok := textRole[event.Role]; ok && event.Event == recordData {
+				sums[role].Write(event.Data)
+			}
+		}
+		session.sums = [2][]byte{sums[Client].Sum(nil), sums[Server].Sum(nil)}
+	}
+
+	return nil
+}
+
+func (r *Recording) Mocks() bool {
+	return r != nil && r.Mode == recordingMock
+}
+
+func (r *Recording) Replays() bool {
+	return r != nil && r.Mode == recordingReplay
+}
+
+func (r *Recording) write(event RecordEvent, now time.Time) {
+	event.Time = now.UnixNano() / int64(time.Microsecond)
+	line, err := json.Marshal(event)
+	if err != nil {
+		logger.PrintlnError(err.Error())
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		logger.PrintlnError(err.Error())
+	}
+}
+
+// Start recording a trip whose client arrived at start. Returns nil unless
+// the route is being recorded.
+func (r *Recording) Open(trip *Trip, start time.Time) *RecordingSession {
+	if r == nil || r.Mode != recordingRecord || r.file == nil {
+		return nil
+	}
+
+	r.write(RecordEvent{Session: trip.Id, Event: recordOpen, Client: trip.src.RemoteAddr().String(), Server: trip.Destination()}, start)
+
+	return &RecordingSession{recording: r, id: trip.Id}
+}
+
+// Record bytes read from one side of the trip
+func (s *RecordingSession) Travel(role Role, buffer []byte) {
+	s.travel(role, buffer, time.Now())
+}
+
+func (s *RecordingSession) travel(role Role, buffer []byte, now time.Time) {
+	if s != nil {
+		s.recording.write(RecordEvent{Session: s.id, Event: recordData, Role: roleText[role], Data: buffer}, now)
+	}
+}
+
+func (s *RecordingSession) Finish(role Role) {
+	if s != nil {
+		s.recording.write(RecordEvent{Session: s.id, Event: recordClose, Role: roleText[role]}, time.Now())
+	}
+}
+
+// Return the recorded session that the next mock connection is served
+func (r *Recording) nextSession() *recordedSession {
+	n := atomic.AddInt64(&r.next, 1) - 1
+	return r.sessions[n%int64(len(r.sessions))]
+}
+
+// Scale a recorded interval by the replay speed
+func (r *Recording) scale(d time.Duration) time.Duration {
+	switch {
+	case r.Speed < 0:
+		return 0
+	case r.Speed == 0:
+		return d
+	}
+
+	return time.Duration(float64(d) / r.Speed)
+}
+
+// Replay the client side of every recorded session, starting each at its
+// recorded time, as if the clients had arrived on the route
+func (r *Recording) Replay(route *Route) {
+	logger.PrintlnInfo("Replaying", len(r.sessions), "sessions from", r.File, "on route", route.Name)
+
+	var wg sync.WaitGroup
+	wg.Add(len(r.sessions))
+
+	start := time.Now()
+	first := r.sessions[0].open.Time
+
+	for i, session := range r.sessions {
+		time.Sleep(time.Until(start.Add(r.scale(time.Duration(session.open.Time-first) * time.Microsecond))))
+
+		go func(i int, session *recordedSession) {
+			defer wg.Done()
+
+			src, player, err := socketPair()
+			if err != nil {
+				logger.PrintlnError("Failed to replay session", session.open.Session, ":", err.Error())
+				return
+			}
+			done := make(chan struct{})
+
+			go func() {
+				sent, received, matched := r.play(player, session, Client)
+				result := "differs from"
+				if matched {
+					result = "matches"
+				}
+				logger.PrintlnInfo("Replayed session", session.open.Session, ": sent", sent, "bytes, received", received, "of", session.bytes[Server], "bytes, response", result, "the recording")
+				close(done)
+			}()
+
+			route.stats.Accept()
+			findRoute(&replayConn{Conn: src, remote: recordedAddr(session.open.Client)}, route, i)
+			<-done
+		}(i, session)
+	}
+
+	wg.Wait()
+
+	logger.PrintlnInfo("Replayed", len(r.sessions), "sessions on route", route.Name)
+}
+
+// Send one side of a recorded session at its recorded timing, waiting for the
+// other side to send what it sent when recorded before going on. Returns the
+// bytes sent and received and whether the received bytes match the recording.
+func (r *Recording) play(con net.Conn, session *recordedSession, role Role) (int64, int64, bool) {
+	defer con.Close()
+
+	peer := Server
+	if role == Server {
+		peer = Client
+	}
+
+	var received int64
+	var mutex sync.Mutex
+	cond := sync.NewCond(&mutex)
+	closed := false
+	sum := sha256.New()
+
+	go func() { // Read the other side until it closes
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := con.Read(buf)
+			mutex.Lock()
+			sum.Write(buf[:n])
+			received = received + int64(n)
+			closed = err != nil
+			cond.Broadcast()
+			mutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Wait, for no longer than the route allows, until the other side has sent
+	// as many bytes as it did when recorded or closed
+	expired := false
+	await := func(bytes int64, close bool) {
+		timer := time.AfterFunc(time.Duration(r.Wait)*time.Millisecond, func() {
+			mutex.Lock()
+			expired = true
+			cond.Broadcast()
+			mutex.Unlock()
+		})
+		defer timer.Stop()
+
+		mutex.Lock()
+		for !expired && !closed && (received < bytes || close) {
+			cond.Wait()
+		}
+		mutex.Unlock()
+	}
+
+	var sent, expected int64
+	start := time.Now()
+
+	for _, event := range session.events {
+		if event.Role == roleText[peer] {
+			if event.Event == recordData {
+				expected = expected + int64(len(event.Data))
+				await(expected, false)
+			} else if event.Event == recordClose {
+				await(expected, true)
+			}
+			continue
+		}
+
+		time.Sleep(time.Until(start.Add(r.scale(time.Duration(event.Time-session.open.Time) * time.Microsecond))))
+
+		if event.Event == recordData {
+			if _, err := con.Write(event.Data); err != nil {
+				break
+			}
+			sent = sent + int64(len(event.Data))
+		} else if event.Event == recordClose {
+			closeWrite(con)
+		}
+	}
+
+	await(session.bytes[peer], false)
+	con.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return sent, received, bytes.Equal(sum.Sum(nil), session.sums[peer])
+}
+
+// The connection of a replayed client or mock server
+type replayConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *replayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *replayConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Connect two ends of a loopback TCP connection so that either end may
+// half-close it
+func socketPair() (net.Conn, net.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		dialed.Close()
+		return nil, nil, err
+	}
+
+	return dialed, accepted, nil
+}
+
+func recordedAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	n, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: n}
+}
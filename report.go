@@ -0,0 +1,145 @@
+package main // Periodic throughput reports of connections and routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+const (
+	reportCsv  = "csv"
+	reportJson = "json"
+	reportLog  = "log"
+)
+
+const reportCsvHeader = "time,tag,elapsed,bytes,total,mbps,final"
+
+var errReportFormat = errors.New("Report format must be \"log\", \"csv\" or \"json\"")
+
+var _reporter *Reporter
+
+type Report struct {
+	Interval int64  `json:"interval"` // Milliseconds between throughput samples of each connection and route (0 = 1000)
+	Format   string `json:"format"`   // "log" (logger), "csv" or "json" (JSON lines)
+	File     string `json:"file"`     // File that csv or json samples are appended to (empty = stdout)
+}
+
+// Writes throughput samples as they are taken
+type Reporter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	format   string
+	out      io.Writer
+}
+
+func NewReporter(report *Report) (*Reporter, error) {
+	reporter := new(Reporter)
+	reporter.interval = time.Duration(report.Interval) * time.Millisecond
+	if reporter.interval <= 0 {
+		reporter.interval = time.Second
+	}
+
+	reporter.format = report.Format
+	switch reporter.format {
+	case "":
+		reporter.format = reportLog
+	case reportLog:
+	case reportCsv, reportJson:
+		reporter.out = os.Stdout
+		if len(report.File) > 0 {
+			file, err := os.OpenFile(report.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, err
+			}
+			reporter.out = file
+		}
+
+		if reporter.format == reportCsv {
+			fmt.Fprintln(reporter.out, reportCsvHeader)
+		}
+	default:
+		return nil, errReportFormat
+	}
+
+	return reporter, nil
+}
+
+// Return new metrics that report to the reporter, if any, at its interval
+func (r *Reporter) NewMetrics(tag string) *Metrics {
+	if r == nil {
+		return MetricsNew(1000*1000*1000*1000, -1, tag)
+	}
+
+	metrics := MetricsNew(int64(r.interval), -1, tag)
+	metrics.reporter = r
+
+	return metrics
+}
+
+func (r *Reporter) Report(sample MetricsSample) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch r.format {
+	case reportLog:
+		text := fmt.Sprintf("%.6f Mbps", sample.Mbps)
+		if sample.Final {
+			logger.PrintlnInfo(sample.Tag, "traveled", sample.Total, "bytes in", time.Duration(sample.Elapsed)*time.Microsecond, "at", text)
+		} else {
+			logger.PrintlnInfo(sample.Tag, "traveled", sample.Bytes, "bytes of", sample.Total, "bytes at", text)
+		}
+	case reportCsv:
+		fmt.Fprintf(r.out, "%s,%t\n", sample.String(), sample.Final)
+	case reportJson:
+		if line, err := json.Marshal(sample); err == nil {
+			r.out.Write(append(line, '\n'))
+		}
+	}
+}
+
+// Sample the bytes read from each side of a route at every interval for as
+// long as the route is intercepted
+func (r *Reporter) WatchRoute(stats *RouteStats) {
+	if r == nil || stats == nil {
+		return
+	}
+
+	var metrics [2]*Metrics
+	var bytes [2]int64
+	for _, role := range []Role{Client, Server} {
+		metrics[role] = MetricsNew(int64(r.interval), -1, "ROUTE-"+stats.Name+"-"+strings.ToUpper(roleText[role]))
+		metrics[role].reporter = r
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var delta [2]int64
+		for _, role := range []Role{Client, Server} {
+			total := atomic.LoadInt64(&stats.Bytes[role])
+			delta[role] = total - bytes[role]
+			bytes[role] = total
+		}
+
+		if delta[Client] == 0 && delta[Server] == 0 && stats.Capacity.Connections.Current() == 0 {
+			continue // Nothing is traveling the route
+		}
+
+		for _, role := range []Role{Client, Server} {
+			metrics[role].Sample(delta[role])
+		}
+	}
+}
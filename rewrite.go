@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type HeaderEdit struct {
+	Add    map[string]string `json:"add"`    // Fields appended to the header
+	Remove []string          `json:"remove"` // Fields removed from the header
+	Set    map[string]string `json:"set"`    // Fields that replace any existing fields of the same name
+}
+
+// Rewrite the headers of HTTP messages whose request matches every condition
+// given. Hosts may use a "*." wildcard prefix and paths a "*" wildcard suffix.
+type RewriteRule struct {
+	Host     string      `json:"host"`     // Request host (without port)
+	Method   string      `json:"method"`   // Request method
+	Path     string      `json:"path"`     // Request path
+	Request  *HeaderEdit `json:"request"`  // Edits applied to the request header
+	Response *HeaderEdit `json:"response"` // Edits applied to the response header
+}
+
+func (r *RewriteRule) Matches(request *http.Request) bool {
+	if len(r.Method) > 0 && !strings.EqualFold(r.Method, request.Method) {
+		return false
+	}
+
+	if len(r.Host) > 0 && r.Host != aclAny {
+		host := request.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		pattern := strings.ToLower(r.Host)
+
+		if strings.HasPrefix(pattern, "*.") {
+			if !strings.HasSuffix(host, pattern[1:]) {
+				return false
+			}
+		} else if host != pattern {
+			return false
+		}
+	}
+
+	if len(r.Path) > 0 {
+		if strings.HasSuffix(r.Path, "*") {
+			if !strings.HasPrefix(request.URL.Path, r.Path[:len(r.Path)-1]) {
+				return false
+			}
+		} else if request.URL.Path != r.Path {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Apply the request or response edits of every rule matching the request
+func rewriteHead(rules []RewriteRule, role Role, request *http.Request, head []byte) []byte {
+	for i := range rules {
+		edit := rules[i].Request
+		if role == Server {
+			edit = rules[i].Response
+		}
+
+		if edit != nil && request != nil && rules[i].Matches(request) {
+			head = edit.Apply(head)
+		}
+	}
+
+	return head
+}
+
+func (e *HeaderEdit) Apply(head []byte) []byte {
+	for _, name := range e.Remove {
+		head = stripHeader(head, name)
+	}
+
+	for _, name := range sortedKeys(e.Set) {
+		head = setHeader(head, name, e.Set[name])
+	}
+
+	for _, name := range sortedKeys(e.Add) {
+		head = addHeader(head, name, e.Add[name])
+	}
+
+	return head
+}
+
+func sortedKeys(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule   RewriteRule
+		method string
+		url    string
+		want   bool
+	}{
+		{RewriteRule{}, "GET", "http://example.com/", true},
+		{RewriteRule{Method: "post"}, "POST", "http://example.com/", true},
+		{RewriteRule{Method: "POST"}, "GET", "http://example.com/", false},
+		{RewriteRule{Host: "*"}, "GET", "http://example.com/", true},
+		{RewriteRule{Host: "Example.com"}, "GET", "http://example.com:8080/", true},
+		{RewriteRule{Host: "example.com"}, "GET", "http://www.example.com/", false},
+		{RewriteRule{Host: "*.example.com"}, "GET", "http://api.EXAMPLE.com/", true},
+		{RewriteRule{Host: "*.example.com"}, "GET", "http://example.com/", false},
+		{RewriteRule{Host: "*.example.com"}, "GET", "http://badexample.com/", false},
+		{RewriteRule{Path: "/api"}, "GET", "http://example.com/api", true},
+		{RewriteRule{Path: "/api"}, "GET", "http://example.com/api/v1", false},
+		{RewriteRule{Path: "/api/*"}, "GET", "http://example.com/api/v1?q=1", true},
+		{RewriteRule{Path: "/api/*"}, "GET", "http://example.com/apis", false},
+		{RewriteRule{Method: "GET", Host: "*.example.com", Path: "/api/*"}, "GET", "http://api.example.com/api/v1", true},
+		{RewriteRule{Method: "GET", Host: "*.example.com", Path: "/api/*"}, "PUT", "http://api.example.com/api/v1", false},
+	}
+
+	for _, test := range tests {
+		request, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := test.rule.Matches(request); got != test.want {
+			t.Errorf("%+v with %s %s: got %t, want %t", test.rule, test.method, test.url, got, test.want)
+		}
+	}
+}
+
+func TestRewriteHead(t *testing.T) {
+	rules := []RewriteRule{
+		{Request: &HeaderEdit{Remove: []string{"Authorization"}, Set: map[string]string{"X-Env": "test"}}},
+		{Path: "/a", Request: &HeaderEdit{Add: map[string]string{"X-Path": "a"}}},
+	}
+
+	request, _ := http.NewRequest("GET", "http://example.com/a", nil)
+	head := []byte("GET /a HTTP/1.1\r\nHost: example.com\r\nAuthorization: Basic Zm9vOmJhcg==\r\nX-Env: prod\r\n\r\n")
+
+	got := string(rewriteHead(rules, Client, request, head))
+	if want := "GET /a HTTP/1.1\r\nHost: example.com\r\nX-Env: test\r\nX-Path: a\r\n\r\n"; got != want {
+		t.Errorf("request: got %q, want %q", got, want)
+	}
+
+	if got := string(rewriteHead(rules, Client, nil, head)); got != string(head) {
+		t.Errorf("header without a request was rewritten: %q", got)
+	}
+}
+
+// Pipelined responses are rewritten by the rules matching the request each
+// one answers, with informational responses answering none
+func TestRewriteResponseOfRequest(t *testing.T) {
+	m := new(MapHttp)
+	m.Impl.Route = &Route{Rewrite: []RewriteRule{
+		{Path: "/a", Response: &HeaderEdit{Set: map[string]string{"X-Rule": "a"}}},
+		{Path: "/b", Response: &HeaderEdit{Set: map[string]string{"X-Rule": "b"}}},
+		{Method: "HEAD", Response: &HeaderEdit{Remove: []string{"Server"}}},
+	}}
+	m.inspect()
+
+	var requests, responses []byte
+	m.streams[Client].Write([]byte("GET /a HTTP/1.1\r\nHost: h\r\n\r\nPOST /b HTTP/1.1\r\nHost: h\r\nContent-Length: 3\r\n\r\nabcHEAD /a HTTP/1.1\r\nHost: h\r\n\r\n"), func(b []byte) error {
+		requests = append(requests, b...)
+		return nil
+	})
+
+	m.streams[Server].Write([]byte(
+		"HTTP/1.1 200 OK\r\nServer: s\r\nContent-Length: 2\r\n\r\nok"+
+			"HTTP/1.1 100 Continue\r\n\r\n"+
+			"HTTP/1.1 201 Created\r\nServer: s\r\nContent-Length: 0\r\n\r\n"+
+			"HTTP/1.1 200 OK\r\nServer: s\r\nContent-Length: 2\r\n\r\n"), func(b []byte) error {
+		responses = append(responses, b...)
+		return nil
+	})
+
+	want := "HTTP/1.1 200 OK\r\nServer: s\r\nContent-Length: 2\r\nX-Rule: a\r\n\r\nok" +
+		"HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 201 Created\r\nServer: s\r\nContent-Length: 0\r\nX-Rule: b\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nX-Rule: a\r\n\r\n"
+	if string(responses) != want {
+		t.Errorf("got %q, want %q", responses, want)
+	}
+
+	if strings.Contains(string(requests), "X-Rule") {
+		t.Errorf("response edits were applied to requests: %q", requests)
+	}
+}
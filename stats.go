@@ -0,0 +1,226 @@
+package main // Running totals for each route in the itinerary
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Destinations other than the configured ones are only kept once a dial to
+// them has failed so that a proxy's stats do not grow with every host visited
+const maxOtherDestinations = 64
+
+var (
+	durationBounds    = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800, 3600}
+	dialLatencyBounds = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+var _stats = struct {
+	mutex  sync.Mutex
+	routes map[string]*RouteStats
+}{routes: make(map[string]*RouteStats)}
+
+// Health of a destination judged by the outcome of dialing it
+type DestinationStats struct {
+	Errors   int64 // Failed dials
+	Failures int64 // Consecutive failed dials
+	LastDial time.Time
+	LastErr  string
+	lastFail time.Time
+}
+
+type RouteStats struct {
+	Name         string
+	Route        *Route    // Live settings of the route
+	Capacity     *Capacity // Connections traveling the route
+	Accepted     int64
+	Refused      int64 // Turned away by the checkpoint or capacity
+	Failed       int64 // No destination could be found or reached
+	Bytes        [2]int64
+	Dropped      [2]int64 // Bytes blocked by flow control
+	Shortcuts    int64
+	Duration     *Histogram // Seconds each connection traveled the route
+	DialLatency  *Histogram // Seconds taken to reach a destination
+	mutex        sync.Mutex
+	destinations map[string]*DestinationStats
+	listenErr    string // Reason the route is not listening
+}
+
+func NewRouteStats(route *Route, capacity *Capacity) *RouteStats {
+	name := route.Name
+	stats := new(RouteStats)
+	stats.Name = name
+	stats.Route = route
+	stats.Capacity = capacity
+	stats.Duration = NewHistogram(durationBounds)
+	stats.DialLatency = NewHistogram(dialLatencyBounds)
+	stats.destinations = make(map[string]*DestinationStats)
+
+	_stats.mutex.Lock()
+	_stats.routes[name] = stats
+	_stats.mutex.Unlock()
+
+	return stats
+}
+
+// Return the stats of every route sorted by name
+func AllRouteStats() []*RouteStats {
+	_stats.mutex.Lock()
+	defer _stats.mutex.Unlock()
+
+	all := make([]*RouteStats, 0, len(_stats.routes))
+	for _, stats := range _stats.routes {
+		all = append(all, stats)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+
+	return all
+}
+
+func FindRouteStats(name string) (*RouteStats, bool) {
+	_stats.mutex.Lock()
+	defer _stats.mutex.Unlock()
+
+	stats, ok := _stats.routes[name]
+	return stats, ok
+}
+
+// All counters may be updated through a nil route stats pointer so that
+// routes built outside of an itinerary need not keep stats
+
+func (s *RouteStats) Accept() {
+	if s != nil {
+		atomic.AddInt64(&s.Accepted, 1)
+	}
+}
+
+func (s *RouteStats) Refuse() {
+	if s != nil {
+		atomic.AddInt64(&s.Refused, 1)
+	}
+}
+
+func (s *RouteStats) Fail() {
+	if s != nil {
+		atomic.AddInt64(&s.Failed, 1)
+	}
+}
+
+func (s *RouteStats) Travel(role Role, bytes int) {
+	if s != nil {
+		atomic.AddInt64(&s.Bytes[role], int64(bytes))
+	}
+}
+
+func (s *RouteStats) Drop(role Role, bytes int) {
+	if s != nil {
+		atomic.AddInt64(&s.Dropped[role], int64(bytes))
+	}
+}
+
+func (s *RouteStats) TakeShortcut() {
+	if s != nil {
+		atomic.AddInt64(&s.Shortcuts, 1)
+	}
+}
+
+func (s *RouteStats) Finish(duration time.Duration) {
+	if s != nil {
+		s.Duration.Observe(duration.Seconds())
+	}
+}
+
+func (s *RouteStats) Dial(addr string, latency time.Duration, err error) {
+	if s == nil {
+		return
+	} else if err == nil {
+		s.DialLatency.Observe(latency.Seconds())
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	d, ok := s.destinations[addr]
+	if !ok {
+		if err == nil && !s.configured(addr) {
+			return
+		}
+		d = new(DestinationStats)
+		s.destinations[addr] = d
+	}
+
+	d.LastDial = time.Now()
+	if err == nil {
+		d.Failures = 0
+	} else {
+		d.Errors = d.Errors + 1
+		d.Failures = d.Failures + 1
+		d.LastErr = err.Error()
+		d.lastFail = d.LastDial
+	}
+
+	if !ok {
+		s.forgetDestinations()
+	}
+}
+
+func (s *RouteStats) configured(addr string) bool {
+	for _, dst := range s.Route.Dst {
+		if dst == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Forget the other destinations that failed least recently once there are
+// too many of them
+func (s *RouteStats) forgetDestinations() {
+	others := make([]string, 0, len(s.destinations))
+	for addr := range s.destinations {
+		if !s.configured(addr) {
+			others = append(others, addr)
+		}
+	}
+
+	if len(others) <= maxOtherDestinations {
+		return
+	}
+
+	sort.Slice(others, func(i, j int) bool {
+		return s.destinations[others[i]].lastFail.Before(s.destinations[others[j]].lastFail)
+	})
+
+	for _, addr := range others[:len(others)-maxOtherDestinations] {
+		delete(s.destinations, addr)
+	}
+}
+
+// Return a copy of the stats of the configured destinations that the route has
+// dialed and of the other destinations it has recently failed to dial
+func (s *RouteStats) Destinations() map[string]DestinationStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	destinations := make(map[string]DestinationStats, len(s.destinations))
+	for addr, d := range s.destinations {
+		destinations[addr] = *d
+	}
+
+	return destinations
+}
+
+func (s *RouteStats) SetListenErr(err error) {
+	s.mutex.Lock()
+	s.listenErr = err.Error()
+	s.mutex.Unlock()
+}
+
+func (s *RouteStats) ListenErr() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listenErr
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+// Recover the address a client was trying to reach before its connection was
+// redirected to the route
+func originalDestination(con net.Conn, mode string) (*net.TCPAddr, error) {
+	tcpCon, ok := unwrapConn(con).(*net.TCPConn)
+	if !ok {
+		return nil, errNotRedirected
+	}
+
+	local, _ := tcpCon.LocalAddr().(*net.TCPAddr)
+
+	switch mode {
+	case transparentTproxy: // The socket is bound to the original destination
+		return local, nil
+	case transparentRedirect:
+	default:
+		return nil, errTransparentMode
+	}
+
+	raw, err := tcpCon.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	ctrlErr := raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			var info *syscall.IPv6MTUInfo // Same size as struct sockaddr_in6
+			if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst); err == nil {
+				port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:]
+				addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port))}
+			}
+		} else {
+			var mreq *syscall.IPv6Mreq // Same size as struct sockaddr_in
+			if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); err == nil {
+				sa := mreq.Multiaddr[:]
+				addr = &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(binary.BigEndian.Uint16(sa[2:4]))}
+			}
+		}
+	})
+
+	if ctrlErr != nil {
+		return nil, ctrlErr
+	} else if err == syscall.ENOENT { // No NAT entry for the connection
+		return nil, errNotRedirected
+	}
+
+	return addr, err
+}
+
+// Allow a listener to accept connections addressed to any destination
+func transparentControl(network, address string, raw syscall.RawConn) error {
+	var err error
+
+	ctrlErr := raw.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err == nil && network == "tcp6" {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+
+	return err
+}
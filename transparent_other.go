@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+func originalDestination(con net.Conn, mode string) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func transparentControl(network, address string, raw syscall.RawConn) error {
+	return errTransparentUnsupported
+}
@@ -0,0 +1,314 @@
+package main // A single connection traveling a route
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Connections that add behavior on top of another connection
+type connWrapper interface {
+	Unwrap() net.Conn
+}
+
+func unwrapConn(con net.Conn) net.Conn {
+	for {
+		wrapper, ok := con.(connWrapper)
+		if !ok {
+			return con
+		}
+		con = wrapper.Unwrap()
+	}
+}
+
+func closeWrite(con net.Conn) error {
+	if con, ok := unwrapConn(con).(closeWriter); ok {
+		return con.CloseWrite()
+	}
+
+	return con.Close()
+}
+
+// Bytes kept of what a client exchanged before its trip started
+const arrivalLimit = 1024 * 1024
+
+// Keeps the bytes read from and written to a client while its route is
+// found so that the trip can account for them once it starts
+type arrivalConn struct {
+	net.Conn
+	mutex  sync.Mutex
+	chunks []arrivalChunk
+	size   int
+	done   bool
+}
+
+type arrivalChunk struct {
+	role   Role // Client if read from the client, Server if written to it
+	time   time.Time
+	buffer []byte
+}
+
+func newArrivalConn(con net.Conn) *arrivalConn {
+	return &arrivalConn{Conn: con}
+}
+
+func (c *arrivalConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.keep(Client, b[:n])
+	return n, err
+}
+
+func (c *arrivalConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.keep(Server, b[:n])
+	return n, err
+}
+
+func (c *arrivalConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *arrivalConn) keep(role Role, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.done {
+		return
+	} else if c.size+len(b) > arrivalLimit { // E.g., a connection served by the map itself
+		c.done = true
+		c.chunks = nil
+		return
+	}
+
+	c.chunks = append(c.chunks, arrivalChunk{role: role, time: time.Now(), buffer: append([]byte(nil), b...)})
+	c.size = c.size + len(b)
+}
+
+// Stop keeping bytes and return those kept so far
+func (c *arrivalConn) Arrive() []arrivalChunk {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	chunks := c.chunks
+	c.done = true
+	c.chunks = nil
+
+	return chunks
+}
+
+// Stop keeping the bytes of a connection that no trip will account for
+func stopArriving(con net.Conn) {
+	for {
+		if arrival, ok := con.(*arrivalConn); ok {
+			arrival.Arrive()
+			return
+		} else if wrapper, ok := con.(connWrapper); ok {
+			con = wrapper.Unwrap()
+		} else {
+			return
+		}
+	}
+}
+
+var _trips = struct {
+	mutex  sync.Mutex
+	lastId int64
+	active map[int64]*Trip
+}{active: make(map[int64]*Trip)}
+
+type Trip struct {
+	Id         int64 // Unique among all routes (0 until the trip is registered)
+	Map        Map
+	Route      *Route
+	Start      time.Time
+	bytes      [2]int64 // Bytes read from each side
+	capture    *CaptureStream
+	recording  *RecordingSession
+	mirror     *MirrorStream
+	finished   int32 // Number of directions that have finished traveling
+	lastActive int64 // Unix timestamp in nanoseconds of the last detoured bytes
+	mutex      sync.Mutex
+	reason     string
+	err        string // Error that ended the trip, if any
+	src        net.Conn
+	dst        net.Conn
+	dstAddr    string // Destination dialed, if known
+	done       chan struct{}
+}
+
+func NewTrip(src net.Conn, dst net.Conn) *Trip {
+	trip := new(Trip)
+	trip.Start = time.Now()
+	trip.lastActive = trip.Start.UnixNano()
+	trip.src = src
+	trip.dst = dst
+	trip.done = make(chan struct{})
+	return trip
+}
+
+// Address of the destination, which is not the peer of dst when the trip
+// departs through an upstream proxy
+func (t *Trip) Destination() string {
+	if len(t.dstAddr) > 0 {
+		return t.dstAddr
+	}
+
+	return t.dst.RemoteAddr().String()
+}
+
+func (t *Trip) Touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+// Count bytes read from one side of the trip
+func (t *Trip) Travel(role Role, bytes int) {
+	atomic.AddInt64(&t.bytes[role], int64(bytes))
+	t.Touch()
+}
+
+func (t *Trip) Bytes(role Role) int64 {
+	return atomic.LoadInt64(&t.bytes[role])
+}
+
+// List the trip among the active trips until it is unregistered
+func (t *Trip) Register(route *Route, mp Map) {
+	_trips.mutex.Lock()
+	defer _trips.mutex.Unlock()
+
+	_trips.lastId = _trips.lastId + 1
+	t.Id = _trips.lastId
+	t.Route = route
+	t.Map = mp
+	_trips.active[t.Id] = t
+}
+
+func (t *Trip) Unregister() {
+	_trips.mutex.Lock()
+	delete(_trips.active, t.Id)
+	_trips.mutex.Unlock()
+}
+
+// Return every registered trip in the order they started
+func ActiveTrips() []*Trip {
+	_trips.mutex.Lock()
+	defer _trips.mutex.Unlock()
+
+	trips := make([]*Trip, 0, len(_trips.active))
+	for _, trip := range _trips.active {
+		trips = append(trips, trip)
+	}
+
+	sort.Slice(trips, func(i, j int) bool { return trips[i].Id < trips[j].Id })
+
+	return trips
+}
+
+// End the trip by closing both sides. Only the first reason is remembered.
+func (t *Trip) End(reason string) {
+	t.end(reason, nil)
+}
+
+// End the trip because of an error
+func (t *Trip) Fail(reason string, err error) {
+	t.end(reason, err)
+}
+
+func (t *Trip) end(reason string, err error) {
+	t.mutex.Lock()
+	first := len(t.reason) == 0
+	if first {
+		t.reason = reason
+		if err != nil {
+			t.err = err.Error()
+		}
+		close(t.done)
+	}
+	t.mutex.Unlock()
+
+	if first {
+		t.src.Close()
+		t.dst.Close()
+	}
+}
+
+// Finish one direction of the trip by half-closing its destination so that
+// the other direction may continue. Returns true once nothing is left to
+// travel in either direction.
+func (t *Trip) Finish(dst net.Conn) bool {
+	if atomic.AddInt32(&t.finished, 1) >= 2 {
+		return true
+	}
+
+	if _, ok := unwrapConn(dst).(closeWriter); ok {
+		return closeWrite(dst) != nil
+	}
+
+	return true
+}
+
+func (t *Trip) Reason() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.reason
+}
+
+func (t *Trip) Err() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.err
+}
+
+// End the trip once it has been idle or traveling for too long
+func (t *Trip) Watch(idle, lifetime time.Duration) {
+	if idle <= 0 && lifetime <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-timer.C:
+			next := time.Duration(-1)
+
+			if lifetime > 0 {
+				left := t.Start.Add(lifetime).Sub(now)
+				if left <= 0 {
+					t.End("lifetime of " + lifetime.String() + " exceeded")
+					return
+				}
+				next = left
+			}
+
+			if idle > 0 {
+				left := time.Unix(0, atomic.LoadInt64(&t.lastActive)).Add(idle).Sub(now)
+				if left <= 0 {
+					t.End("idle for " + idle.String())
+					return
+				}
+				if next < 0 || left < next {
+					next = left
+				}
+			}
+
+			timer.Reset(next)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main // Parent proxy that a route's destinations are reached through
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	upstreamHttp    = "http"
+	upstreamSocks5  = "socks5"
+	upstreamSocks5h = "socks5h"
+)
+
+type Upstream struct {
+	Proxy   string   `json:"proxy"`   // Parent proxy URL (http://[user:password@]host:port or socks5://[user:password@]host:port)
+	NoProxy []string `json:"noProxy"` // Destinations dialed directly using ACL rule syntax (names are matched without being resolved)
+	url     *url.URL
+	noProxy *Acl
+}
+
+var (
+	errUpstreamAuth     = errors.New("upstream proxy rejected credentials")
+	errUpstreamUnloaded = errors.New("upstream proxy is not configured correctly")
+)
+
+func (u *Upstream) Load() error {
+	parsed, err := url.Parse(u.Proxy)
+	if err != nil {
+		return err
+	}
+
+	switch parsed.Scheme {
+	case upstreamHttp, upstreamSocks5, upstreamSocks5h:
+	default:
+		return errors.New("unsupported upstream proxy scheme '" + parsed.Scheme + "'")
+	}
+
+	if len(parsed.Port()) == 0 {
+		return errors.New("upstream proxy '" + u.Proxy + "' has no port")
+	}
+
+	u.noProxy = &Acl{Allow: u.NoProxy}
+	if err = u.noProxy.Load(); err == nil {
+		u.url = parsed
+	}
+
+	return err
+}
+
+// Decide whether a destination must be reached through the parent proxy
+func (u *Upstream) Proxies(host string, ip net.IP, port int) bool {
+	if u.url == nil { // Never loaded, so Dial refuses rather than bypass the parent
+		return true
+	} else if len(u.NoProxy) == 0 {
+		return true
+	}
+
+	_, direct := u.noProxy.Permits(host, ip, port)
+	return !direct
+}
+
+// Connect to a destination through the parent proxy. The dialer's timeout
+// covers both the connection to the parent and its handshake.
+func (u *Upstream) Dial(dialer *net.Dialer, addr string) (net.Conn, error) {
+	if u.url == nil {
+		return nil, errUpstreamUnloaded
+	}
+
+	con, err := dialer.Dial("tcp", u.url.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if dialer.Timeout > 0 {
+		con.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+
+	if u.url.Scheme == upstreamHttp {
+		con, err = u.connect(con, addr)
+	} else {
+		err = u.socksConnect(con, addr)
+	}
+
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+
+	con.SetDeadline(time.Time{})
+	return con, nil
+}
+
+// Ask an HTTP parent to open a tunnel to the destination
+func (u *Upstream) connect(con net.Conn, addr string) (net.Conn, error) {
+	var buf bytes.Buffer
+	buf.WriteString(methodConnect + " " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n")
+	if user := u.url.User; user != nil {
+		password, _ := user.Password()
+		buf.WriteString(proxyAuthorization + ": " + basicScheme + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)) + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	if _, err := con.Write(buf.Bytes()); err != nil {
+		return con, err
+	}
+
+	reader := bufio.NewReader(con)
+	response, err := http.ReadResponse(reader, &http.Request{Method: methodConnect})
+	if err != nil {
+		return con, err
+	}
+
+	if response.StatusCode == http.StatusProxyAuthRequired {
+		response.Body.Close()
+		return con, errUpstreamAuth
+	} else if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return con, errors.New("upstream proxy " + u.url.Host + " refused tunnel to " + addr + ": " + response.Status)
+	}
+
+	// Keep any bytes the destination sent right after the tunnel opened
+	if n := reader.Buffered(); n > 0 {
+		head, _ := reader.Peek(n)
+		con = &prefixConn{Conn: con, reader: io.MultiReader(bytes.NewReader(head), con)}
+	}
+
+	return con, nil
+}
+
+// Ask a SOCKS5 parent to connect to the destination
+func (u *Upstream) socksConnect(con net.Conn, addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{socksMethodNone}
+	if u.url.User != nil {
+		methods = []byte{socksMethodPassword}
+	}
+
+	if _, err = con.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 3)
+	if _, err = io.ReadFull(con, reply[:2]); err != nil {
+		return err
+	} else if reply[0] != socksVersion {
+		return errSocksVersion
+	} else if reply[1] != methods[0] {
+		return errSocksMethod
+	}
+
+	if reply[1] == socksMethodPassword {
+		user := u.url.User.Username()
+		password, _ := u.url.User.Password()
+
+		auth := append([]byte{socksAuthVersion, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err = con.Write(auth); err != nil {
+			return err
+		}
+
+		if _, err = io.ReadFull(con, reply[:2]); err != nil {
+			return err
+		} else if reply[1] != 0x00 {
+			return errUpstreamAuth
+		}
+	}
+
+	// socks5 resolves names locally while socks5h leaves it to the parent
+	ip := net.ParseIP(host)
+	if ip == nil && u.url.Scheme == upstreamSocks5 {
+		var ips []net.IP
+		if ips, err = net.LookupIP(host); err != nil {
+			return err
+		}
+		ip = ips[0]
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0x00}
+	if ip != nil {
+		req = append(req, socksAddr(&net.TCPAddr{IP: ip, Port: portNum})...)
+	} else if len(host) > 255 {
+		return errSocksAddress
+	} else {
+		req = append(append(req, socksAtypDomain, byte(len(host))), host...)
+		req = append(req, byte(portNum>>8), byte(portNum))
+	}
+
+	if _, err = con.Write(req); err != nil {
+		return err
+	}
+
+	if _, err = io.ReadFull(con, reply); err != nil {
+		return err
+	} else if reply[1] != socksReplySucceeded {
+		return socksReplyError(reply[1])
+	}
+
+	_, err = readSocksAddr(con)
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/shanebarnes/goto/logger"
+)
+
+var webSocketOpcodeText = map[byte]string{
+	0x0: "continuation",
+	0x1: "text",
+	0x2: "binary",
+	0x8: "close",
+	0x9: "ping",
+	0xa: "pong",
+}
+
+// Logs the frames of one direction of a WebSocket connection (RFC 6455)
+type WebSocketTap struct {
+	header  []byte
+	remain  uint64 // Payload bytes left in the current frame (or bytes left ahead of the first frame)
+	onFrame func(opcode byte, fin, masked bool, size uint64)
+}
+
+func NewWebSocketTap(tag string) *WebSocketTap {
+	tap := new(WebSocketTap)
+	tap.header = make([]byte, 0, 14)
+	tap.onFrame = func(opcode byte, fin, masked bool, size uint64) {
+		name, ok := webSocketOpcodeText[opcode]
+		if !ok {
+			name = "reserved"
+		}
+
+		logger.PrintlnInfo(tag, "WebSocket frame: opcode", name, "("+strconv.Itoa(int(opcode))+")", "fin", fin, "masked", masked, "size", size)
+	}
+	return tap
+}
+
+// Ignore bytes that are written ahead of the first frame (e.g., the response
+// that switched protocols)
+func (t *WebSocketTap) Skip(n int) {
+	t.remain = t.remain + uint64(n)
+}
+
+func (t *WebSocketTap) Write(buffer []byte) {
+	for len(buffer) > 0 {
+		if t.remain > 0 {
+			n := uint64(len(buffer))
+			if n > t.remain {
+				n = t.remain
+			}
+			buffer = buffer[n:]
+			t.remain = t.remain - n
+			continue
+		}
+
+		n := t.headerLen() - len(t.header)
+		if n > len(buffer) {
+			n = len(buffer)
+		}
+		t.header = append(t.header, buffer[:n]...)
+		buffer = buffer[n:]
+
+		if len(t.header) == t.headerLen() {
+			t.logFrame()
+		}
+	}
+}
+
+// Return the length of the current frame header (as far as it is known)
+func (t *WebSocketTap) headerLen() int {
+	n := 2
+
+	if len(t.header) >= 2 {
+		switch t.header[1] & 0x7f {
+		case 126:
+			n = n + 2
+		case 127:
+			n = n + 8
+		}
+
+		if t.header[1]&0x80 != 0 {
+			n = n + 4
+		}
+	}
+
+	return n
+}
+
+func (t *WebSocketTap) logFrame() {
+	var size uint64
+
+	switch length := t.header[1] & 0x7f; length {
+	case 126:
+		size = uint64(binary.BigEndian.Uint16(t.header[2:]))
+	case 127:
+		size = binary.BigEndian.Uint64(t.header[2:])
+	default:
+		size = uint64(length)
+	}
+
+	t.onFrame(t.header[0]&0x0f, t.header[0]&0x80 != 0, t.header[1]&0x80 != 0, size)
+
+	t.header = t.header[:0]
+	t.remain = size
+}
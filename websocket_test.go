@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A connection that keeps everything written to it
+type bufferConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+type webSocketFrame struct {
+	opcode byte
+	fin    bool
+	masked bool
+	size   uint64
+}
+
+func newTestTap(frames *[]webSocketFrame) *WebSocketTap {
+	tap := NewWebSocketTap("test")
+	tap.onFrame = func(opcode byte, fin, masked bool, size uint64) {
+		*frames = append(*frames, webSocketFrame{opcode, fin, masked, size})
+	}
+	return tap
+}
+
+func testWebSocketFrames() ([]byte, []webSocketFrame) {
+	var b []byte
+	b = append(b, 0x81, 0x85, 1, 2, 3, 4)
+	b = append(b, "hello"...)
+	b = append(b, 0x02, 126, 0x01, 0x00)
+	b = append(b, make([]byte, 256)...)
+	b = append(b, 0x80, 127, 0, 0, 0, 0, 0, 1, 0x00, 0x00)
+	b = append(b, make([]byte, 65536)...)
+	b = append(b, 0x89, 0x00)
+
+	return b, []webSocketFrame{{0x1, true, true, 5}, {0x2, false, false, 256}, {0x0, true, false, 65536}, {0x9, true, false, 0}}
+}
+
+func TestWebSocketTap(t *testing.T) {
+	input, want := testWebSocketFrames()
+
+	for _, size := range []int{1, 2, 3, 7, 100, 4096, len(input)} {
+		var frames []webSocketFrame
+		tap := newTestTap(&frames)
+
+		for i := 0; i < len(input); i = i + size {
+			end := i + size
+			if end > len(input) {
+				end = len(input)
+			}
+			tap.Write(input[i:end])
+		}
+
+		if len(frames) != len(want) {
+			t.Fatalf("split every %d bytes: got frames %+v, want %+v", size, frames, want)
+		}
+		for i := range want {
+			if frames[i] != want[i] {
+				t.Errorf("split every %d bytes: frame %d is %+v, want %+v", size, i, frames[i], want[i])
+			}
+		}
+	}
+}
+
+// Frames sent in the same read as the switching response, and cut short by
+// it, are framed from their first byte
+func TestWebSocketTapAfterSwitch(t *testing.T) {
+	input, want := testWebSocketFrames()
+	switching := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+
+	for _, cut := range []int{1, 7, 9, 300} {
+		client, server := new(bufferConn), new(bufferConn)
+
+		m := new(MapHttp)
+		m.Impl.Route = &Route{WebSocketLog: true}
+		m.Impl.Src, m.Impl.Dst = client, server
+		m.Impl.Shortcut = new(ShortcutNull)
+		m.Impl.Shortcut.New(0, client, server, 0, false)
+		m.inspect()
+
+		if err := m.detour(Client, []byte("GET /chat HTTP/1.1\r\nHost: h\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		// The taps only exist once the switch is made
+		if err := m.detour(Server, append([]byte(switching), input[:cut]...)); err != nil {
+			t.Fatal(err)
+		}
+
+		var frames []webSocketFrame
+		if m.taps[Server] == nil {
+			t.Fatal("no tap after switching protocols")
+		}
+		m.taps[Server].onFrame = newTestTap(&frames).onFrame
+
+		m.detour(Server, input[cut:])
+
+		if sent := client.written.Bytes(); !strings.HasPrefix(string(sent), switching) || !bytes.Equal(sent[len(switching):], input) {
+			t.Errorf("cut at %d: client was sent %d bytes, want %d", cut, len(sent), len(switching)+len(input))
+		}
+
+		// Frames completed in the first read were logged before the test saw them
+		if len(frames) == 0 || frames[len(frames)-1] != want[len(want)-1] {
+			t.Errorf("cut at %d: got frames %+v", cut, frames)
+		}
+		for i := range frames {
+			if frames[i] != want[len(want)-len(frames)+i] {
+				t.Errorf("cut at %d: frame %d is %+v, want %+v", cut, i, frames[i], want[len(want)-len(frames)+i])
+			}
+		}
+	}
+}